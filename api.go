@@ -15,16 +15,28 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func uuidv4() (string, error) {
@@ -53,24 +65,47 @@ func (r *statusReponse) WriteHeader(status int) {
 	r.ResponseWriter.WriteHeader(status)
 }
 
+// Hijack lets handlers take over the connection, to upgrade to WebSocket.
+func (r *statusReponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can not be taken over")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
 func middlewareWrapper(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var err error
 
 		id := r.Header.Get("X-Request-ID")
-		if id == "" {
+		if id != "" {
+			r = r.WithContext(withClientRequestID(r.Context()))
+		} else {
 			id, err = uuidv4()
 			if err != nil {
 				id = "-"
 			}
 			r.Header.Set("X-Request-ID", id)
 		}
-		ip := r.Header.Get("X-Real-IP")
-		if ip == "" {
-			s := strings.Split(r.RemoteAddr, ":")
-			ip = s[0]
-			r.Header.Set("X-Real-IP", ip)
-		}
+		// Handlers downstream rely on X-Real-IP, so it is always replaced
+		// with the address we have established ourselves.
+		ip := clientIP(r, trustedProxies)
+		r.Header.Set("X-Real-IP", ip)
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("yubihsm.request_id", id),
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("client.address", ip),
+				attribute.String("user_agent.original", r.UserAgent()),
+			))
+		defer span.End()
+		r = r.WithContext(ctx)
 
 		clog := log.WithFields(log.Fields{
 			"X-Request-ID":   id,
@@ -83,6 +118,24 @@ func middlewareWrapper(next http.HandlerFunc) http.HandlerFunc {
 			"URI":            r.URL.RequestURI(),
 		})
 
+		if r.TLS != nil {
+			if weak := weakTLS(r.TLS); weak != "" {
+				clog.WithFields(log.Fields{
+					"TLS-Version":      tls.VersionName(r.TLS.Version),
+					"TLS-Cipher-Suite": tls.CipherSuiteName(r.TLS.CipherSuite),
+				}).Warnf("weak TLS %s negotiated", weak)
+			}
+		}
+
+		cred, local := unixPeer(r.Context())
+		if cred != nil {
+			clog = clog.WithFields(log.Fields{
+				"Peer-UID": cred.uid,
+				"Peer-GID": cred.gid,
+				"Peer-PID": cred.pid,
+			})
+		}
+
 		defer func() {
 			if rcv := recover(); rcv != nil {
 				clog.WithField("panic", rcv).Error("recovered from handler panic")
@@ -94,12 +147,48 @@ func middlewareWrapper(next http.HandlerFunc) http.HandlerFunc {
 			}
 		}()
 
-		if hostHeaderAllowlisting && !validateHost(r.Host) {
+		// Browsers can't be made to talk to Unix sockets, so there is no
+		// DNS rebinding to guard against there.
+		l := listenerFrom(r.Context())
+		if !local && !l.validHost(r.Host) {
 			clog.WithField("host", r.Host).Error("host not in allowlist")
 			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
 
+		pol := activePolicy.Load()
+		client := pol.identify(r, ip)
+		clog = clog.WithField("client", client.id)
+		release, retryAfter, ok := pol.limits.admit(client)
+		if !ok {
+			clog.Warn("client over limits")
+			audit("rate-limited", log.Fields{
+				"X-Request-ID": id,
+				"X-Real-IP":    ip,
+				"client":       client.id,
+				"policy":       client.entry.Name,
+				"URI":          r.URL.RequestURI(),
+			})
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		r = r.WithContext(withIdentity(r.Context(), client))
+
+		if !l.authorized(r, client) {
+			clog.WithField("auth", l.Auth).Warn("client presented no required credentials")
+			audit("unauthorized", log.Fields{
+				"X-Request-ID": id,
+				"X-Real-IP":    ip,
+				"client":       client.id,
+				"listen":       l.Listen,
+				"URI":          r.URL.RequestURI(),
+			})
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
 		response := &statusReponse{
 			ResponseWriter: w,
 		}
@@ -113,7 +202,11 @@ func middlewareWrapper(next http.HandlerFunc) http.HandlerFunc {
 			"latency":    latency,
 			"StatusCode": response.status,
 		}
-		if response.status != http.StatusOK {
+		span.SetAttributes(attribute.Int("http.response.status_code", response.status))
+		if response.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(response.status))
+		}
+		if response.status != http.StatusOK && response.status != http.StatusSwitchingProtocols {
 			clog.WithFields(fields).Error("error in handling request")
 		} else {
 			clog.WithFields(fields).Info("handled request")
@@ -138,7 +231,7 @@ func statusHandler(w http.ResponseWriter, r *http.Request, serial string) {
 	})
 
 	var status string
-	if err = usbCheck(cid, serial); err != nil {
+	if err = deviceCheck(r.Context(), cid, serial); err != nil {
 		status = "NO_DEVICE"
 		clog.WithError(err).Warn("status failed to open usb device")
 	} else {
@@ -146,7 +239,11 @@ func statusHandler(w http.ResponseWriter, r *http.Request, serial string) {
 	}
 
 	// Deal with address/port in ycshell.
-	split := strings.Split(viper.GetString("listen"), ":")
+	listen := listenerFrom(r.Context()).Listen
+	split := strings.Split(listen, ":")
+	if isUnixAddr(listen) {
+		split = []string{listen, ""}
+	}
 
 	fmt.Fprintf(w, "status=%s\n", status)
 	if serial == "" {
@@ -158,19 +255,47 @@ func statusHandler(w http.ResponseWriter, r *http.Request, serial string) {
 	fmt.Fprintf(w, "pid=%d\n", os.Getpid())
 	fmt.Fprintf(w, "address=%s\n", split[0])
 	fmt.Fprintf(w, "port=%s\n", split[1])
+
+	depth, clients := deviceScheduler.stats()
+	fmt.Fprintf(w, "queue=%d\n", depth)
+	if holder, held, busy := deviceScheduler.holding(); busy {
+		fmt.Fprintf(w, "holder=%s\n", holder)
+		fmt.Fprintf(w, "holder-time=%s\n", held)
+	}
+	// Only clients with requests waiting, to not tell every caller
+	// about everyone who has been around.
+	for _, c := range clients {
+		if c.depth == 0 {
+			continue
+		}
+		var avg time.Duration
+		if c.count > 0 {
+			avg = c.wait / time.Duration(c.count)
+		}
+		fmt.Fprintf(w, "queue-client=%s,%d,%s\n", c.client, c.depth, avg)
+	}
+	for _, c := range sockets.stats() {
+		fmt.Fprintf(w, "websocket=%s,%s,%s\n", c.id, c.client, sessionList(c.sessions))
+	}
+	names, leaves := certificateExpiry()
+	for i, leaf := range leaves {
+		fmt.Fprintf(w, "certificate=%s,%s,%d\n", names[i], leaf.NotAfter.Format(time.RFC3339), int(expiryDays(leaf)))
+	}
 }
 
+const min_len = 3        // The minimum request is CMD (1 byte) + LEN (2 bytes)
+const max_len = 3136 + 3 // Allow 3 bytes more than the HSM can handle before returning http.StatusBadRequest
+
 func apiHandler(w http.ResponseWriter, r *http.Request, serial string) {
 	var buf []byte
 	var n int
 	var err error
-	const min_len = 3        // The minimum request is CMD (1 byte) + LEN (2 bytes)
-	const max_len = 3136 + 3 // Allow 3 bytes more than the HSM can handle before returning http.StatusBadRequest
 
 	cid := r.Header.Get("X-Request-ID")
 	clog := log.WithFields(log.Fields{
 		"X-Request-ID": cid,
 	})
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("yubihsm.serial", serial))
 
 	if r.Method != "POST" {
 		w.Header().Set("Allow", "POST")
@@ -179,25 +304,92 @@ func apiHandler(w http.ResponseWriter, r *http.Request, serial string) {
 		return
 	}
 
-	if r.ContentLength < min_len || r.ContentLength > max_len {
+	// Bodies of undeclared length, chunked or from HTTP/2 clients that
+	// don't send content-length, are held to the same bounds once read.
+	if r.ContentLength >= 0 && (r.ContentLength < min_len || r.ContentLength > max_len) {
 		http.Error(w, http.StatusText(http.StatusBadRequest),
 			http.StatusBadRequest)
 		return
 	}
 
-    if buf, err = io.ReadAll(io.LimitReader(r.Body, max_len)); err != nil {
+	if buf, err = io.ReadAll(io.LimitReader(r.Body, max_len+1)); err != nil {
 		clog.WithError(err).Error("failed reading incoming request")
 		http.Error(w, http.StatusText(http.StatusInternalServerError),
 			http.StatusInternalServerError)
 		return
 	}
 
-	if buf, err = usbProxy(buf, cid, serial); err != nil {
-		clog.WithError(err).Error("failed usb proxy")
-		http.Error(w, http.StatusText(http.StatusInternalServerError),
-			http.StatusInternalServerError)
+	if len(buf) < min_len || len(buf) > max_len {
+		http.Error(w, http.StatusText(http.StatusBadRequest),
+			http.StatusBadRequest)
+		return
+	}
+
+	if err = validateRequest(buf, allowUnknownCommands); err != nil {
+		clog.WithError(err).Warn("rejected malformed request")
+		writeProblem(w, http.StatusBadRequest, "Malformed frame", err.Error())
+		return
+	}
+
+	timeout, err := requestTimeout(r.Header.Get("X-Request-Timeout"), maxRequestTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	req := buf
+	var resp []byte
+	var proxyErr error
+	if responseCache != nil && hasClientRequestID(ctx) && len(cid) <= maxRequestIDLen {
+		key := identityFrom(ctx).id + " " + cid
+		cached, entry, cerr := responseCache.begin(ctx, key, req)
+		switch {
+		case errors.Is(cerr, errIdempotencyConflict):
+			clog.WithError(cerr).Warn("rejected conflicting retry")
+			writeProblem(w, http.StatusConflict, "Request ID reused", cerr.Error())
+			return
+		case errors.Is(cerr, errIdempotencyUnknown):
+			clog.WithError(cerr).Warn("rejected retry of request with unknown outcome")
+			writeProblem(w, http.StatusConflict, "Request outcome unknown", cerr.Error())
+			return
+		case cerr != nil:
+			clog.WithError(cerr).Warn("gave up waiting for original request")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable),
+				http.StatusServiceUnavailable)
+			return
+		case cached != nil:
+			clog.Debug("answering retry from response cache")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(cached)
+			return
+		case entry != nil:
+			// Carry on should the client go away, so that its retry
+			// finds the response rather than running the command again.
+			ctx = context.WithoutCancel(ctx)
+			defer func() { responseCache.finish(key, entry, resp, proxyErr) }()
+		}
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	buf, err = deviceProxy(ctx, req, cid, serial)
+	if err != nil {
+		proxyErr = err
+		writeProxyError(w, clog, err, timeout)
 		return
 	}
+	resp = buf
+
+	if err = rec.record(req, buf); err != nil {
+		clog.WithError(err).Warn("failed recording exchange")
+	}
+	sockets.observe(nil, req, buf)
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	if n, err = w.Write(buf); err != nil {
@@ -218,6 +410,85 @@ func apiHandler(w http.ResponseWriter, r *http.Request, serial string) {
 	}
 }
 
+// proxyErrorStatus maps an error from the device, or from waiting for
+// it, to an HTTP status.
+func proxyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errQueueFull), errors.Is(err, errQueueTimeout), errors.Is(err, errDraining):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errDesync):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// writeProxyError answers a request the device could not, or did not in
+// time.
+func writeProxyError(w http.ResponseWriter, clog *log.Entry, err error, timeout time.Duration) {
+	status := proxyErrorStatus(err)
+	switch status {
+	case http.StatusServiceUnavailable:
+		clog.WithError(err).Warn("request shed")
+		w.Header().Set("Retry-After", "1")
+	case http.StatusGatewayTimeout:
+		clog.WithError(err).WithField("timeout", timeout).Warn("request deadline exceeded")
+	case http.StatusBadGateway:
+		clog.WithError(err).Error("device out of sync, command outcome unknown")
+	default:
+		clog.WithError(err).Error("failed usb proxy")
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// Commands not known to be YubiHSM 2 commands are rejected unless set.
+var allowUnknownCommands bool
+
+// problem is an RFC 7807 problem details body.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, status int, title string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&problem{
+		Type:   "about:blank",
+		Title:  title,
+		Status: status,
+		Detail: detail,
+	})
+}
+
+// Upper bound on the time a request may take, including waiting for the
+// device. Zero means requests may take as long as they need.
+var maxRequestTimeout time.Duration
+
+var errRequestTimeout = fmt.Errorf("invalid X-Request-Timeout")
+
+// requestTimeout determines the deadline for a request, from the client's
+// X-Request-Timeout header, either milliseconds or a duration like "1.5s",
+// capped by max.
+func requestTimeout(header string, max time.Duration) (time.Duration, error) {
+	var timeout time.Duration
+	if header != "" {
+		if ms, err := strconv.ParseUint(header, 10, 32); err == nil {
+			timeout = time.Duration(ms) * time.Millisecond
+		} else if timeout, err = time.ParseDuration(header); err != nil || timeout < 0 {
+			return 0, errRequestTimeout
+		}
+	}
+	if max > 0 && (timeout == 0 || timeout > max) {
+		timeout = max
+	}
+	return timeout, nil
+}
+
 func extractHost(addr string) string {
 	if strings.Contains(addr, ":") {
 		idx := strings.LastIndex(addr, ":")
@@ -233,9 +504,9 @@ func extractHost(addr string) string {
 	return addr
 }
 
-func validateHost(addr string) bool {
+func validateHost(addr string, allowlist []string) bool {
 	host := extractHost(addr)
-	for _, h := range hostHeaderAllowlist {
+	for _, h := range allowlist {
 		if h == host {
 			return true
 		}
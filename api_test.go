@@ -0,0 +1,159 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stubDevice has requests answered by device, instead of a YubiHSM 2,
+// for the duration of the test.
+func stubDevice(t *testing.T, device func(req []byte) ([]byte, error)) {
+	proxy := deviceProxy
+	t.Cleanup(func() { deviceProxy = proxy })
+	deviceProxy = func(ctx context.Context, req []byte, cid string, serial string) ([]byte, error) {
+		return device(req)
+	}
+}
+
+func TestAPIHandler(t *testing.T) {
+	stubDevice(t, echoDevice)
+
+	for _, test := range []struct {
+		method string
+		body   []byte
+		status int
+		title  string
+	}{
+		{"POST", []byte{0x01, 0x00, 0x02, 0xca, 0xfe}, http.StatusOK, ""},
+		{"GET", nil, http.StatusMethodNotAllowed, ""},
+		{"POST", []byte{0x01, 0x00}, http.StatusBadRequest, ""},
+		{"POST", []byte{0x01, 0x00, 0x03, 0xca, 0xfe}, http.StatusBadRequest, "Malformed frame"},
+		{"POST", []byte{0x81, 0x00, 0x00}, http.StatusBadRequest, "Malformed frame"},
+		{"POST", []byte{0x7e, 0x00, 0x00}, http.StatusBadRequest, "Malformed frame"},
+	} {
+		w := httptest.NewRecorder()
+		apiHandler(w, httptest.NewRequest(test.method, "/connector/api", bytes.NewReader(test.body)), "")
+		if w.Code != test.status {
+			t.Errorf("%s %x: got %d: expected %d", test.method, test.body, w.Code, test.status)
+			continue
+		}
+		switch {
+		case test.status == http.StatusOK:
+			if want, _ := echoDevice(test.body); !bytes.Equal(w.Body.Bytes(), want) {
+				t.Errorf("%x: got %x: expected %x", test.body, w.Body.Bytes(), want)
+			}
+		case test.title != "":
+			var p problem
+			if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("%x: got content type %q", test.body, ct)
+			} else if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Errorf("%x: %v", test.body, err)
+			} else if p.Title != test.title || p.Status != test.status || p.Detail == "" {
+				t.Errorf("%x: got %+v", test.body, p)
+			}
+		}
+	}
+}
+
+func TestAPIHandlerChunked(t *testing.T) {
+	stubDevice(t, echoDevice)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != -1 || len(r.TransferEncoding) == 0 {
+			t.Errorf("got a body of length %d, encoded %v", r.ContentLength, r.TransferEncoding)
+		}
+		apiHandler(w, r, "")
+	}))
+	defer ts.Close()
+
+	for _, test := range []struct {
+		body   []byte
+		status int
+	}{
+		{[]byte{0x01, 0x00, 0x02, 0xca, 0xfe}, http.StatusOK},
+		{buildFrame(cmdEcho, make([]byte, max_len-frameHeaderLen)), http.StatusOK},
+		{buildFrame(cmdEcho, make([]byte, max_len-frameHeaderLen+1)), http.StatusBadRequest},
+		{[]byte{0x01, 0x00}, http.StatusBadRequest},
+	} {
+		// Hiding the length of the body has it sent chunked.
+		body := io.MultiReader(bytes.NewReader(test.body))
+		resp, err := http.Post(ts.URL, "application/octet-stream", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%d bytes: got %d: expected %d", len(test.body), resp.StatusCode, test.status)
+		} else if want, _ := echoDevice(test.body); test.status == http.StatusOK && !bytes.Equal(got, want) {
+			t.Errorf("got %x: expected %x", got, want)
+		}
+	}
+}
+
+func TestAPIHandlerRetries(t *testing.T) {
+	defer func(c *idempotencyCache) { responseCache = c }(responseCache)
+	responseCache = newIdempotencyCache(time.Minute)
+
+	var sent int
+	var fail error
+	stubDevice(t, func(req []byte) ([]byte, error) {
+		sent++
+		if fail != nil {
+			return nil, fail
+		}
+		return echoDevice(req)
+	})
+
+	frame := []byte{0x01, 0x00, 0x02, 0xca, 0xfe}
+	post := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/connector/api", bytes.NewReader(frame))
+		r.Header.Set("X-Request-ID", id)
+		r = r.WithContext(withClientRequestID(r.Context()))
+		w := httptest.NewRecorder()
+		apiHandler(w, r, "")
+		return w
+	}
+
+	for _, test := range []struct {
+		id     string
+		fail   error
+		status int
+		sent   int
+	}{
+		// Shed before reaching the device, so tried again.
+		{"a", errQueueFull, http.StatusServiceUnavailable, 1},
+		{"a", nil, http.StatusOK, 2},
+		{"a", nil, http.StatusOK, 2},
+		// Timed out waiting for the answer, so never again.
+		{"b", context.DeadlineExceeded, http.StatusGatewayTimeout, 3},
+		{"b", nil, http.StatusConflict, 3},
+		{"c", errDesync, http.StatusBadGateway, 4},
+		{"c", nil, http.StatusConflict, 4},
+	} {
+		fail = test.fail
+		w := post(test.id)
+		if w.Code != test.status || sent != test.sent {
+			t.Fatalf("%s: got %d after %d sent: expected %d after %d", test.id, w.Code, sent, test.status, test.sent)
+		}
+	}
+}
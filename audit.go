@@ -0,0 +1,47 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// auditLog records policy decisions. Unless an audit log file is
+// configured, entries go to the regular log, marked with an audit field.
+var auditLog = log.StandardLogger()
+
+func auditInit(path string) error {
+	if path == "" {
+		auditLog = log.StandardLogger()
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l := log.New()
+	l.SetOutput(f)
+	l.SetFormatter(&log.JSONFormatter{})
+	auditLog = l
+
+	return nil
+}
+
+func audit(event string, fields log.Fields) {
+	auditLog.WithFields(fields).WithField("audit", event).Warn("audit")
+}
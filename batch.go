@@ -0,0 +1,171 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Most frames accepted in a single batch.
+const maxBatchFrames = 64
+
+// splitFrames splits a batch into its frames. Frames carry their own
+// length in the LEN field of the header, so a batch is simply frames
+// back to back. Each frame is held to the same checks as a single
+// request to apiHandler.
+func splitFrames(buf []byte, allowUnknown bool) (frames [][]byte, err error) {
+	for len(buf) > 0 {
+		if len(frames) == maxBatchFrames {
+			return nil, fmt.Errorf("more than %d frames", maxBatchFrames)
+		}
+		if len(buf) < frameHeaderLen {
+			return nil, fmt.Errorf("frame %d: %w", len(frames), errFrameShort)
+		}
+		n := frameHeaderLen + int(binary.BigEndian.Uint16(buf[1:3]))
+		if n < min_len || n > max_len {
+			return nil, fmt.Errorf("frame %d: length %d out of bounds", len(frames), n)
+		}
+		if n > len(buf) {
+			return nil, fmt.Errorf("frame %d: %w: LEN is %d, but %d bytes of data follow",
+				len(frames), errFrameLength, n-frameHeaderLen, len(buf)-frameHeaderLen)
+		}
+		if err = validateRequest(buf[:n], allowUnknown); err != nil {
+			return nil, fmt.Errorf("frame %d: %w", len(frames), err)
+		}
+		frames = append(frames, buf[:n])
+		buf = buf[n:]
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("empty batch")
+	}
+	return frames, nil
+}
+
+// batchHandler runs a batch of frames back to back, without letting
+// other clients use the device in between, and answers with the
+// responses back to back. With stop-on-error set, the batch ends at the
+// first error response from the device.
+//
+// The number of frames answered is returned in X-Batch-Frames. Should
+// the device fail part way, the responses so far are returned along with
+// X-Batch-Error.
+func batchHandler(w http.ResponseWriter, r *http.Request, serial string) {
+	var buf []byte
+	var err error
+
+	cid := r.Header.Get("X-Request-ID")
+	clog := log.WithFields(log.Fields{
+		"X-Request-ID": cid,
+	})
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	stop := false
+	if v := r.URL.Query().Get("stop-on-error"); v != "" {
+		if stop, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid stop-on-error", http.StatusBadRequest)
+			return
+		}
+	}
+
+	const maxBatchLen = maxBatchFrames * max_len
+	if r.ContentLength > maxBatchLen {
+		http.Error(w, http.StatusText(http.StatusBadRequest),
+			http.StatusBadRequest)
+		return
+	}
+	if buf, err = io.ReadAll(io.LimitReader(r.Body, maxBatchLen+1)); err != nil {
+		clog.WithError(err).Error("failed reading incoming request")
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	if len(buf) > maxBatchLen {
+		http.Error(w, http.StatusText(http.StatusBadRequest),
+			http.StatusBadRequest)
+		return
+	}
+
+	frames, err := splitFrames(buf, allowUnknownCommands)
+	if err != nil {
+		clog.WithError(err).Warn("rejected malformed batch")
+		writeProblem(w, http.StatusBadRequest, "Malformed batch", err.Error())
+		return
+	}
+
+	timeout, err := requestTimeout(r.Header.Get("X-Request-Timeout"), maxRequestTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ctx, done, err := deviceScheduler.hold(ctx, cid)
+	if err != nil {
+		writeProxyError(w, clog, err, timeout)
+		return
+	}
+	defer done()
+
+	var out bytes.Buffer
+	var answered int
+	for _, req := range frames {
+		var resp []byte
+		if resp, err = deviceProxy(ctx, req, cid, serial); err != nil {
+			break
+		}
+		if err := rec.record(req, resp); err != nil {
+			clog.WithError(err).Warn("failed recording exchange")
+		}
+		sockets.observe(nil, req, resp)
+		out.Write(resp)
+		answered++
+		if f, _ := parseFrame(resp); stop && f.isError() {
+			break
+		}
+	}
+	if err != nil {
+		if answered == 0 {
+			writeProxyError(w, clog, err, timeout)
+			return
+		}
+		clog.WithError(err).WithField("answered", answered).Error("batch failed part way")
+		w.Header().Set("X-Batch-Error", err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Batch-Frames", strconv.Itoa(answered))
+	if _, err = w.Write(out.Bytes()); err != nil {
+		clog.WithError(err).Error("failed response write")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestBatchHandler(t *testing.T) {
+	echo := []byte{0x01, 0x00, 0x02, 0xca, 0xfe}
+	echoResp := []byte{0x81, 0x00, 0x02, 0xca, 0xfe}
+	info := []byte{0x06, 0x00, 0x00}
+	infoErr := []byte{0x7f, 0x00, 0x01, 0x03}
+
+	// The device answers DeviceInfo with an error, and fails outright
+	// at frame failAt, counting from 1.
+	var sent, failAt int
+	stubDevice(t, func(req []byte) ([]byte, error) {
+		if sent++; sent == failAt {
+			return nil, errDesync
+		}
+		if req[0] == cmdDeviceInfo {
+			return infoErr, nil
+		}
+		return echoDevice(req)
+	})
+
+	batch := bytes.Join([][]byte{echo, info, echo}, nil)
+	for _, test := range []struct {
+		query  string
+		body   []byte
+		failAt int
+		status int
+		frames int
+		resp   []byte
+		err    bool
+	}{
+		{"", batch, 0, http.StatusOK, 3, bytes.Join([][]byte{echoResp, infoErr, echoResp}, nil), false},
+		{"?stop-on-error=true", batch, 0, http.StatusOK, 2, bytes.Join([][]byte{echoResp, infoErr}, nil), false},
+		{"?stop-on-error=false", batch, 3, http.StatusOK, 2, bytes.Join([][]byte{echoResp, infoErr}, nil), true},
+		{"", batch, 1, http.StatusBadGateway, 0, nil, false},
+		{"?stop-on-error=maybe", batch, 0, http.StatusBadRequest, 0, nil, false},
+		{"", append(echo, 0x01, 0x00), 0, http.StatusBadRequest, 0, nil, false},
+	} {
+		sent, failAt = 0, test.failAt
+		w := httptest.NewRecorder()
+		batchHandler(w, httptest.NewRequest("POST", "/connector/api/batch"+test.query, bytes.NewReader(test.body)), "")
+
+		if w.Code != test.status {
+			t.Errorf("%q: got %d: expected %d", test.query, w.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if frames := w.Header().Get("X-Batch-Frames"); frames != strconv.Itoa(test.frames) {
+			t.Errorf("%q: got %s frames: expected %d", test.query, frames, test.frames)
+		}
+		if !bytes.Equal(w.Body.Bytes(), test.resp) {
+			t.Errorf("%q: got %x: expected %x", test.query, w.Body.Bytes(), test.resp)
+		}
+		if batchErr := w.Header().Get("X-Batch-Error"); (batchErr != "") != test.err {
+			t.Errorf("%q: got error %q", test.query, batchErr)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	// How often certificates are checked for expiry, besides when
+	// loaded.
+	certCheckInterval = 12 * time.Hour
+	// Certificates expiring within this long, or within the last third
+	// of their lifetime if that is shorter, are warned about.
+	certExpiryWarning = 14 * 24 * time.Hour
+)
+
+// certSource is where a TLS certificate and its key are read from: PEM
+// cert and key files, or a PKCS#12 bundle instead. The key, or the
+// bundle, may be encrypted with a passphrase read from a file, an
+// environment variable or a systemd credential.
+type certSource struct {
+	Cert                 string `mapstructure:"cert"`
+	Key                  string `mapstructure:"key"`
+	PKCS12               string `mapstructure:"pkcs12"`
+	PassphraseFile       string `mapstructure:"key-passphrase-file"`
+	PassphraseEnv        string `mapstructure:"key-passphrase-env"`
+	PassphraseCredential string `mapstructure:"key-passphrase-credential"`
+}
+
+// certSourceFrom returns the certificate configured in v outside of
+// listeners.
+func certSourceFrom(v *viper.Viper) certSource {
+	return certSource{
+		Cert:                 v.GetString("cert"),
+		Key:                  v.GetString("key"),
+		PKCS12:               v.GetString("pkcs12"),
+		PassphraseFile:       v.GetString("key-passphrase-file"),
+		PassphraseEnv:        v.GetString("key-passphrase-env"),
+		PassphraseCredential: v.GetString("key-passphrase-credential"),
+	}
+}
+
+// configured returns whether there is a certificate to serve.
+func (s certSource) configured() bool {
+	return s.Cert != "" || s.PKCS12 != ""
+}
+
+func (s certSource) validate() error {
+	if s.PKCS12 != "" && (s.Cert != "" || s.Key != "") {
+		return fmt.Errorf("pkcs12 replaces cert and key, specify either")
+	}
+	if (s.Cert == "") != (s.Key == "") {
+		return fmt.Errorf("cert and key must both be specified")
+	}
+
+	passphrases := 0
+	for _, source := range []string{s.PassphraseFile, s.PassphraseEnv, s.PassphraseCredential} {
+		if source != "" {
+			passphrases++
+		}
+	}
+	if passphrases > 1 {
+		return fmt.Errorf("key-passphrase-file, key-passphrase-env and key-passphrase-credential are exclusive")
+	} else if passphrases > 0 && !s.configured() {
+		return fmt.Errorf("a key passphrase requires key or pkcs12")
+	}
+	if s.PassphraseCredential != "" {
+		if os.Getenv("CREDENTIALS_DIRECTORY") == "" {
+			return fmt.Errorf("key-passphrase-credential requires credentials passed by systemd")
+		}
+		if strings.ContainsRune(s.PassphraseCredential, '/') {
+			return fmt.Errorf("invalid key-passphrase-credential %q", s.PassphraseCredential)
+		}
+	}
+	return nil
+}
+
+// passphrase returns the passphrase for the key, if any.
+func (s certSource) passphrase() (string, error) {
+	switch {
+	case s.PassphraseFile != "":
+		b, err := os.ReadFile(s.PassphraseFile)
+		return strings.TrimRight(string(b), "\r\n"), err
+	case s.PassphraseEnv != "":
+		passphrase, ok := os.LookupEnv(s.PassphraseEnv)
+		if !ok {
+			return "", fmt.Errorf("key passphrase variable %s not set", s.PassphraseEnv)
+		}
+		return passphrase, nil
+	case s.PassphraseCredential != "":
+		path := filepath.Join(os.Getenv("CREDENTIALS_DIRECTORY"), s.PassphraseCredential)
+		b, err := os.ReadFile(path)
+		return strings.TrimRight(string(b), "\r\n"), err
+	}
+	return "", nil
+}
+
+// files returns the files the certificate is read from.
+func (s certSource) files() (files []string) {
+	for _, file := range []string{s.Cert, s.Key, s.PKCS12, s.PassphraseFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// liveCert is the certificate a TLS server presents, which may be swapped
+// while serving, and is once watched and its files change.
+type liveCert struct {
+	pair atomic.Pointer[tls.Certificate]
+
+	mtx     sync.Mutex
+	name    string // the address served, for logs and metrics
+	src     certSource
+	watcher *fsnotify.Watcher
+	dirs    map[string]bool // watched for changes to src
+}
+
+// Certificates being watched, for status and metrics.
+var liveCerts struct {
+	mtx   sync.Mutex
+	certs []*liveCert
+}
+
+// loadCertificate reads a certificate and its key.
+func loadCertificate(src certSource) (*tls.Certificate, error) {
+	passphrase, err := src.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	if src.PKCS12 != "" {
+		return loadPKCS12(src.PKCS12, passphrase)
+	}
+
+	certPEM, err := os.ReadFile(src.Cert)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(src.Key)
+	if err != nil {
+		return nil, err
+	}
+	if keyPEM, err = decryptKey(keyPEM, passphrase); err != nil {
+		return nil, fmt.Errorf("%s: %w", src.Key, err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if pair.Leaf == nil {
+		if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &pair, nil
+}
+
+// decryptKey returns the PEM key in keyPEM decrypted with passphrase, if
+// it is encrypted.
+func decryptKey(keyPEM []byte, passphrase string) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return keyPEM, nil // for tls.X509KeyPair to complain about
+	}
+	if block.Headers["Proc-Type"] == "4,ENCRYPTED" {
+		return nil, errors.New("legacy PEM encryption is not supported, convert the key with openssl pkcs8 -topk8")
+	}
+	if block.Type != "ENCRYPTED PRIVATE KEY" {
+		return keyPEM, nil
+	}
+	if passphrase == "" {
+		return nil, errors.New("key is encrypted, but no passphrase is configured")
+	}
+
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// loadPKCS12 reads a certificate, its chain and key from a PKCS#12
+// bundle.
+func loadPKCS12(path string, passphrase string) (*tls.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+	}
+	if public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !public.Equal(leaf.PublicKey) {
+		return nil, fmt.Errorf("%s: private key does not match public key", path)
+	}
+
+	pair := &tls.Certificate{PrivateKey: key, Leaf: leaf}
+	for _, cert := range append([]*x509.Certificate{leaf}, chain...) {
+		pair.Certificate = append(pair.Certificate, cert.Raw)
+	}
+	return pair, nil
+}
+
+// load reads the certificate and key, and presents them from then on.
+func (c *liveCert) load(src certSource) error {
+	pair, err := loadCertificate(src)
+	if err != nil {
+		return err
+	}
+	c.set(src, pair)
+	return nil
+}
+
+// set presents pair, as read from src, from now on.
+func (c *liveCert) set(src certSource, pair *tls.Certificate) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.setLocked(src, pair)
+}
+
+func (c *liveCert) setLocked(src certSource, pair *tls.Certificate) {
+	c.src = src
+	if c.watcher != nil {
+		c.watchFiles()
+	}
+	old := c.pair.Swap(pair)
+	if old != nil && bytes.Equal(old.Certificate[0], pair.Certificate[0]) {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"listen":    c.name,
+		"subject":   pair.Leaf.Subject.String(),
+		"not-after": pair.Leaf.NotAfter.Format(time.RFC3339),
+		"days-left": int(expiryDays(pair.Leaf)),
+	}).Info("certificate loaded")
+	c.checkExpiry()
+}
+
+// get is for tls.Config.GetCertificate.
+func (c *liveCert) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.pair.Load(), nil
+}
+
+func expiryDays(leaf *x509.Certificate) float64 {
+	return time.Until(leaf.NotAfter).Hours() / 24
+}
+
+// expiresSoon returns whether leaf is near enough its expiry to warn
+// about.
+func expiresSoon(leaf *x509.Certificate, now time.Time) bool {
+	warning := min(certExpiryWarning, leaf.NotAfter.Sub(leaf.NotBefore)/3)
+	return leaf.NotAfter.Sub(now) < warning
+}
+
+func (c *liveCert) checkExpiry() {
+	leaf := c.pair.Load().Leaf
+	clog := log.WithFields(log.Fields{
+		"listen":    c.name,
+		"not-after": leaf.NotAfter.Format(time.RFC3339),
+	})
+	if now := time.Now(); now.After(leaf.NotAfter) {
+		clog.Error("certificate expired")
+	} else if expiresSoon(leaf, now) {
+		clog.WithField("days-left", int(expiryDays(leaf))).Warn("certificate expires soon")
+	}
+}
+
+// refresh reads the certificate and key again, carrying on with the
+// current certificate if they don't load.
+func (c *liveCert) refresh() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	pair, err := loadCertificate(c.src)
+	if err != nil {
+		log.WithField("listen", c.name).WithError(err).Warn("certificate not reloaded, carrying on with the current one")
+		return
+	}
+	c.setLocked(c.src, pair)
+}
+
+// watchFiles watches the directories of the certificate files, to follow
+// them being replaced, by renames or symlinks, as well as written to.
+// Directories of files no longer read from are let go of.
+func (c *liveCert) watchFiles() {
+	dirs := map[string]bool{}
+	for _, file := range c.src.files() {
+		dir := filepath.Dir(file)
+		if dirs[dir] {
+			continue
+		}
+		if !c.dirs[dir] {
+			if err := c.watcher.Add(dir); err != nil {
+				log.WithField("listen", c.name).WithError(err).Warn("not watching certificate files for changes")
+				continue
+			}
+		}
+		dirs[dir] = true
+	}
+	for dir := range c.dirs {
+		if !dirs[dir] {
+			c.watcher.Remove(dir)
+		}
+	}
+	c.dirs = dirs
+}
+
+// watch reloads the certificate whenever its files change, and checks
+// its expiry now and then.
+func (c *liveCert) watch() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.WithField("listen", c.name).WithError(err).Warn("not watching certificate files for changes")
+		return
+	}
+	c.mtx.Lock()
+	c.watcher = watcher
+	c.watchFiles()
+	c.mtx.Unlock()
+
+	liveCerts.mtx.Lock()
+	liveCerts.certs = append(liveCerts.certs, c)
+	liveCerts.mtx.Unlock()
+
+	go func() {
+		check := time.NewTicker(certCheckInterval)
+		defer check.Stop()
+		var settle <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// Any change may be one to the files, through
+				// symlinks, and reloading unchanged files is harmless.
+				if event.Op != fsnotify.Chmod {
+					settle = time.After(reloadSettle)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.WithField("listen", c.name).WithError(err).Warn("error watching certificate files")
+			case <-settle:
+				settle = nil
+				c.refresh()
+			case <-check.C:
+				c.checkExpiry()
+			}
+		}
+	}()
+}
+
+// unwatch stops following the certificate files, and reporting on the
+// certificate, as watch started to.
+func (c *liveCert) unwatch() {
+	c.mtx.Lock()
+	watcher := c.watcher
+	c.watcher, c.dirs = nil, nil
+	c.mtx.Unlock()
+	if watcher == nil {
+		return
+	}
+	watcher.Close()
+
+	liveCerts.mtx.Lock()
+	defer liveCerts.mtx.Unlock()
+	for i, x := range liveCerts.certs {
+		if x == c {
+			liveCerts.certs = append(liveCerts.certs[:i], liveCerts.certs[i+1:]...)
+			break
+		}
+	}
+}
+
+// certificateExpiry returns the address and leaf certificate of each
+// certificate being watched.
+func certificateExpiry() (names []string, leaves []*x509.Certificate) {
+	liveCerts.mtx.Lock()
+	certs := append([]*liveCert(nil), liveCerts.certs...)
+	liveCerts.mtx.Unlock()
+
+	sort.Slice(certs, func(i, j int) bool { return certs[i].name < certs[j].name })
+	for _, c := range certs {
+		names = append(names, c.name)
+		leaves = append(leaves, c.pair.Load().Leaf)
+	}
+	return names, leaves
+}
+
+func init() {
+	registry = append(registry, collectorFunc(func(w io.Writer) {
+		names, leaves := certificateExpiry()
+
+		fmt.Fprintf(w, "# HELP yubihsm_connector_certificate_expiry_days Days until the certificate served expires.\n")
+		fmt.Fprintf(w, "# TYPE yubihsm_connector_certificate_expiry_days gauge\n")
+		for i, leaf := range leaves {
+			fmt.Fprintf(w, "yubihsm_connector_certificate_expiry_days%s %g\n",
+				labelString([]string{"listen"}, []string{names[i]}), expiryDays(leaf))
+		}
+	}))
+}
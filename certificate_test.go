@@ -0,0 +1,227 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// writeTestCertificate writes a self-signed certificate valid until
+// notAfter, and its key, to dir.
+func writeTestCertificate(t *testing.T, dir string, cn string, notAfter time.Time) (cert string, key string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, key = filepath.Join(dir, "connector.crt"), filepath.Join(dir, "connector.key")
+	if err = os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestExpiresSoon(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	for _, test := range []struct {
+		lifetime time.Duration
+		left     time.Duration
+		soon     bool
+	}{
+		{365 * day, 30 * day, false},
+		{365 * day, 13 * day, true},
+		{90 * day, 20 * day, false},
+		{3 * day, 2 * day, false},
+		{3 * day, 23 * time.Hour, true},
+		{3 * day, -time.Hour, true},
+	} {
+		leaf := &x509.Certificate{
+			NotBefore: now.Add(test.left - test.lifetime),
+			NotAfter:  now.Add(test.left),
+		}
+		if soon := expiresSoon(leaf, now); soon != test.soon {
+			t.Errorf("%s left of %s: got %v", test.left, test.lifetime, soon)
+		}
+	}
+}
+
+func TestLiveCertWatch(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeTestCertificate(t, dir, "a.example.com", time.Now().Add(24*time.Hour))
+
+	c := &liveCert{name: "localhost:1"}
+	if err := c.load(certSource{Cert: cert, Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	c.watch()
+	t.Cleanup(c.unwatch)
+
+	names, leaves := certificateExpiry()
+	if len(names) != 1 || names[0] != c.name || leaves[0].Subject.CommonName != "a.example.com" {
+		t.Fatalf("got %v, %v", names, leaves)
+	}
+
+	writeTestCertificate(t, dir, "b.example.com", time.Now().Add(48*time.Hour))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if pair, _ := c.get(nil); pair.Leaf.Subject.CommonName == "b.example.com" {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("certificate not reloaded")
+		}
+	}
+
+	// A broken key leaves the current certificate be.
+	if err := os.WriteFile(key, []byte("nonsense"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.refresh()
+	if pair, _ := c.get(nil); pair.Leaf.Subject.CommonName != "b.example.com" {
+		t.Fatalf("got %s", pair.Leaf.Subject.CommonName)
+	}
+
+	// Moving the certificate elsewhere lets go of its old directory.
+	other := t.TempDir()
+	cert, key = writeTestCertificate(t, other, "c.example.com", time.Now().Add(24*time.Hour))
+	if err := c.load(certSource{Cert: cert, Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	c.mtx.Lock()
+	dirs := c.dirs
+	c.mtx.Unlock()
+	if len(dirs) != 1 || !dirs[other] {
+		t.Fatalf("watching %v: expected only %s", dirs, other)
+	}
+
+	c.unwatch()
+	if names, _ := certificateExpiry(); len(names) != 0 {
+		t.Fatalf("still reporting on %v", names)
+	}
+}
+
+func TestLoadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeTestCertificate(t, dir, "a.example.com", time.Now().Add(time.Hour))
+
+	pair, err := loadCertificate(certSource{Cert: cert, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, leaf := pair.PrivateKey, pair.Leaf
+
+	der, err := pkcs8.MarshalPrivateKey(priv, []byte("sesame"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := filepath.Join(dir, "encrypted.key")
+	if err = os.WriteFile(encrypted, pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p12, err := pkcs12.Modern.Encode(priv, leaf, nil, "sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(dir, "bundle.p12")
+	if err = os.WriteFile(bundle, p12, 0600); err != nil {
+		t.Fatal(err)
+	}
+	passphrase := filepath.Join(dir, "passphrase")
+	if err = os.WriteFile(passphrase, []byte("sesame\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_KEY_PASSPHRASE", "sesame")
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+
+	for _, test := range []struct {
+		src certSource
+		err string
+	}{
+		{certSource{Cert: cert, Key: encrypted, PassphraseFile: passphrase}, ""},
+		{certSource{Cert: cert, Key: encrypted, PassphraseEnv: "TEST_KEY_PASSPHRASE"}, ""},
+		{certSource{Cert: cert, Key: encrypted, PassphraseCredential: "passphrase"}, ""},
+		{certSource{PKCS12: bundle, PassphraseEnv: "TEST_KEY_PASSPHRASE"}, ""},
+		{certSource{Cert: cert, Key: encrypted}, "no passphrase"},
+		{certSource{Cert: cert, Key: encrypted, PassphraseEnv: "TEST_NO_PASSPHRASE"}, "not set"},
+		{certSource{Cert: cert, Key: encrypted, PassphraseFile: cert}, "incorrect password"},
+		{certSource{PKCS12: bundle}, "password incorrect"},
+	} {
+		pair, err := loadCertificate(test.src)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%+v: got %v, wanted %q", test.src, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", test.src, err)
+		} else if !pair.Leaf.Equal(leaf) || !priv.(*ecdsa.PrivateKey).Equal(pair.PrivateKey) {
+			t.Errorf("%+v: loaded another certificate", test.src)
+		}
+	}
+}
+
+func TestCertSourceInvalid(t *testing.T) {
+	for _, config := range []string{
+		"listeners: [{listen: \"localhost:1\", key: a.key}]",
+		"listeners: [{listen: \"localhost:1\", cert: a.crt, key: a.key, pkcs12: a.p12}]",
+		"listeners: [{listen: \"localhost:1\", key-passphrase-file: passphrase}]",
+		"listeners: [{listen: \"localhost:1\", pkcs12: a.p12, key-passphrase-file: passphrase, key-passphrase-env: PASSPHRASE}]",
+		"listeners: [{listen: \"localhost:1\", pkcs12: a.p12, key-passphrase-credential: passphrase}]",
+	} {
+		if _, err := loadTestListeners(t, config); err == nil {
+			t.Errorf("%q was accepted", config)
+		}
+	}
+
+	listeners, err := loadTestListeners(t, "listeners: [{listen: \"localhost:1\", pkcs12: a.p12, key-passphrase-env: PASSPHRASE}]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (certSource{PKCS12: "a.p12", PassphraseEnv: "PASSPHRASE"}); listeners[0].certSource != want || !listeners[0].tls() {
+		t.Fatalf("got %+v", listeners[0].certSource)
+	}
+}
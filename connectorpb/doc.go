@@ -0,0 +1,20 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package connectorpb holds the gRPC service of the connector, generated
+// from connector.proto. The generated files are committed, so building
+// doesn't take protoc; after changing connector.proto, regenerate them
+// with protoc-gen-go and protoc-gen-go-grpc installed by running
+// "make proto".
+package connectorpb
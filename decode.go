@@ -0,0 +1,167 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// decodeFrame pretty prints a single wire frame and the plaintext fields
+// we know how to interpret.
+func decodeFrame(w io.Writer, buf []byte) {
+	f, err := parseFrame(buf)
+	if err != nil {
+		fmt.Fprintf(w, "  invalid frame: %s: %x\n", err, buf)
+		return
+	}
+
+	dir := ">"
+	if f.isResponse() || f.isError() {
+		dir = "<"
+	}
+	fmt.Fprintf(w, "%s %s\n", dir, f)
+
+	field := func(name string, format string, args ...interface{}) {
+		fmt.Fprintf(w, "    %-20s "+format+"\n", append([]interface{}{name + ":"}, args...)...)
+	}
+
+	d := f.data
+	switch f.cmd {
+	case cmdEcho, cmdEcho | cmdResponse:
+		field("data", "%x", d)
+	case cmdCreateSession:
+		if len(d) >= 2 {
+			field("key_id", "%d", binary.BigEndian.Uint16(d[0:2]))
+			field("host_challenge", "%x", d[2:])
+		}
+	case cmdCreateSession | cmdResponse:
+		if len(d) >= 17 {
+			field("session_id", "%d", d[0])
+			field("card_challenge", "%x", d[1:9])
+			field("card_cryptogram", "%x", d[9:17])
+		}
+	case cmdAuthenticateSession:
+		if len(d) >= 17 {
+			field("session_id", "%d", d[0])
+			field("host_cryptogram", "%x", d[1:9])
+			field("mac", "%x", d[9:17])
+		}
+	case cmdSessionMessage, cmdSessionMessage | cmdResponse:
+		if len(d) >= 9 {
+			field("session_id", "%d", d[0])
+			field("encrypted_len", "%d", len(d)-9)
+			field("mac", "%x", d[len(d)-8:])
+		}
+	case cmdDeviceInfo | cmdResponse:
+		if len(d) >= 9 {
+			field("version", "%d.%d.%d", d[0], d[1], d[2])
+			field("serial", "%d", binary.BigEndian.Uint32(d[3:7]))
+			field("log_total", "%d", d[7])
+			field("log_used", "%d", d[8])
+			field("algorithms", "%v", d[9:])
+		}
+	case cmdError:
+		if code, ok := f.errorCode(); ok {
+			field("error", "%s (0x%02x)", errorName(code), code)
+		}
+	}
+}
+
+var (
+	// Text formatted debug logs print the frame as a list of decimals.
+	textBufRe = regexp.MustCompile(`buf="?\[([0-9 ]*)\]"?`)
+	// JSON formatted debug logs print the frame base64 encoded.
+	jsonBufRe = regexp.MustCompile(`"buf":"([A-Za-z0-9+/=]*)"`)
+)
+
+// frameFromLogLine extracts the frame from a "usb endpoint write" or
+// "usb endpoint read" debug log line.
+func frameFromLogLine(line string) ([]byte, bool) {
+	if !strings.Contains(line, "usb endpoint write") &&
+		!strings.Contains(line, "usb endpoint read") {
+		return nil, false
+	}
+
+	if m := textBufRe.FindStringSubmatch(line); m != nil {
+		fields := strings.Fields(m[1])
+		buf := make([]byte, 0, len(fields))
+		for _, s := range fields {
+			b, err := strconv.ParseUint(s, 10, 8)
+			if err != nil {
+				return nil, false
+			}
+			buf = append(buf, byte(b))
+		}
+		return buf, true
+	}
+	if m := jsonBufRe.FindStringSubmatch(line); m != nil {
+		buf, err := base64.StdEncoding.DecodeString(m[1])
+		if err != nil {
+			return nil, false
+		}
+		return buf, true
+	}
+
+	return nil, false
+}
+
+// decodeStream decodes every frame found in rd, which may be a capture
+// file, a debug log or plain hex, one frame per line.
+func decodeStream(w io.Writer, rd io.Reader) error {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "{") {
+			var e exchange
+			if err := json.Unmarshal([]byte(line), &e); err == nil && e.Request != nil {
+				fmt.Fprintf(w, "# %s\n", e.Time.Format("2006-01-02T15:04:05.000Z07:00"))
+				decodeFrame(w, e.Request)
+				decodeFrame(w, e.Response)
+				continue
+			}
+		}
+		if buf, ok := frameFromLogLine(line); ok {
+			decodeFrame(w, buf)
+			continue
+		}
+		if buf, err := decodeHex(line); err == nil {
+			decodeFrame(w, buf)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// decodeHex accepts hex with optional whitespace, colons and 0x prefix.
+func decodeHex(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "0x")
+	s = strings.NewReplacer(" ", "", ":", "", "\t", "").Replace(s)
+	return hex.DecodeString(s)
+}
@@ -0,0 +1,83 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errDesync is returned when the device's answers can't be matched to
+// the request, and the device has been reset. The command may or may not
+// have been executed.
+var errDesync = fmt.Errorf("device response out of sync with request")
+
+// Stale responses skipped while looking for the answer to a request,
+// before giving up and resetting the device.
+const maxStaleResponses = 2
+
+// How long to wait for the answer to an abandoned command before giving
+// up and resetting the device. Some operations, like generating large RSA
+// keys, legitimately take a long time.
+const staleResponseTimeout = 30 * time.Second
+
+var (
+	desyncs = newCounter("yubihsm_connector_desync_total",
+		"Responses not matching the request they were read for.", "kind")
+	desyncRecoveries = newCounter("yubihsm_connector_desync_recovered_total",
+		"Requests answered correctly after skipping stale responses.")
+	desyncResets = newCounter("yubihsm_connector_desync_resets_total",
+		"Device resets following unrecoverable desynchronization.")
+)
+
+// readResponse reads the answer to req using read. An answer to an
+// earlier command is left over from an abandoned exchange, and the real
+// answer follows it, so a few of those are skipped. Anything else means
+// we've lost track of the device, and errDesync is returned for the
+// caller to reset it.
+func readResponse(cid string, req []byte, read func() ([]byte, error)) (resp []byte, err error) {
+	for i := 0; ; i++ {
+		if resp, err = read(); err != nil {
+			return nil, err
+		}
+
+		err = checkResponse(req, resp)
+		if err == nil {
+			if i > 0 {
+				desyncRecoveries.inc()
+			}
+			return resp, nil
+		}
+
+		kind := "malformed"
+		if err == errStaleResponse {
+			kind = "stale"
+		}
+		desyncs.inc(kind)
+		log.WithFields(log.Fields{
+			"Correlation-ID": cid,
+			"request":        fmt.Sprintf("%x", req[:1]),
+			"response":       fmt.Sprintf("%x", resp),
+			"error":          err,
+		}).Warn("response does not match request")
+
+		if err != errStaleResponse || i >= maxStaleResponses {
+			desyncResets.inc()
+			return nil, errDesync
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// YubiHSM 2 frames are CMD (1 byte) + LEN (2 bytes, big endian) + DATA.
+// Responses carry CMD | 0x80, or cmdError followed by an error code.
+const (
+	frameHeaderLen = 3
+
+	cmdEcho                = 0x01
+	cmdCreateSession       = 0x03
+	cmdAuthenticateSession = 0x04
+	cmdSessionMessage      = 0x05
+	cmdDeviceInfo          = 0x06
+
+	cmdResponse = 0x80
+	cmdError    = 0x7f
+)
+
+var commandNames = map[byte]string{
+	0x01: "Echo",
+	0x03: "CreateSession",
+	0x04: "AuthenticateSession",
+	0x05: "SessionMessage",
+	0x06: "DeviceInfo",
+	0x08: "ResetDevice",
+	0x0a: "GetDevicePublicKey",
+	0x40: "CloseSession",
+	0x41: "GetStorageInfo",
+	0x42: "PutOpaque",
+	0x43: "GetOpaque",
+	0x44: "PutAuthenticationKey",
+	0x45: "PutAsymmetricKey",
+	0x46: "GenerateAsymmetricKey",
+	0x47: "SignPkcs1",
+	0x48: "ListObjects",
+	0x49: "DecryptPkcs1",
+	0x4a: "ExportWrapped",
+	0x4b: "ImportWrapped",
+	0x4c: "PutWrapKey",
+	0x4d: "GetLogEntries",
+	0x4e: "GetObjectInfo",
+	0x4f: "SetOption",
+	0x50: "GetOption",
+	0x51: "GetPseudoRandom",
+	0x52: "PutHmacKey",
+	0x53: "SignHmac",
+	0x54: "GetPublicKey",
+	0x55: "SignPss",
+	0x56: "SignEcdsa",
+	0x57: "DeriveEcdh",
+	0x58: "DeleteObject",
+	0x59: "DecryptOaep",
+	0x5a: "GenerateHmacKey",
+	0x5b: "GenerateWrapKey",
+	0x5c: "VerifyHmac",
+	0x5d: "SignSshCertificate",
+	0x5e: "PutTemplate",
+	0x5f: "GetTemplate",
+	0x60: "DecryptOtp",
+	0x61: "CreateOtpAead",
+	0x62: "RandomizeOtpAead",
+	0x63: "RewrapOtpAead",
+	0x64: "SignAttestationCertificate",
+	0x65: "PutOtpAeadKey",
+	0x66: "GenerateOtpAeadKey",
+	0x67: "SetLogIndex",
+	0x68: "WrapData",
+	0x69: "UnwrapData",
+	0x6a: "SignEddsa",
+	0x6b: "BlinkDevice",
+	0x6c: "ChangeAuthenticationKey",
+	0x6d: "PutSymmetricKey",
+	0x6e: "GenerateSymmetricKey",
+	0x6f: "DecryptEcb",
+	0x70: "EncryptEcb",
+	0x71: "DecryptCbc",
+	0x72: "EncryptCbc",
+	0x7f: "Error",
+}
+
+var errorNames = map[byte]string{
+	0x00: "OK",
+	0x01: "INVALID_COMMAND",
+	0x02: "INVALID_DATA",
+	0x03: "INVALID_SESSION",
+	0x04: "AUTHENTICATION_FAILED",
+	0x05: "SESSIONS_FULL",
+	0x06: "SESSION_FAILED",
+	0x07: "STORAGE_FAILED",
+	0x08: "WRONG_LENGTH",
+	0x09: "INSUFFICIENT_PERMISSIONS",
+	0x0a: "LOG_FULL",
+	0x0b: "OBJECT_NOT_FOUND",
+	0x0c: "INVALID_ID",
+	0x0e: "SSH_CA_CONSTRAINT_VIOLATION",
+	0x0f: "INVALID_OTP",
+	0x10: "DEMO_MODE",
+	0x11: "OBJECT_EXISTS",
+	0x12: "ALGORITHM_DISABLED",
+	0xff: "COMMAND_UNEXECUTED",
+}
+
+type frame struct {
+	cmd  byte
+	data []byte
+}
+
+var (
+	errFrameShort  = fmt.Errorf("frame shorter than header")
+	errFrameLength = fmt.Errorf("frame length field does not match data")
+)
+
+// parseFrame splits buf into a frame, checking that the LEN field
+// matches the amount of data that follows the header.
+func parseFrame(buf []byte) (f frame, err error) {
+	if len(buf) < frameHeaderLen {
+		return f, errFrameShort
+	}
+	n := int(binary.BigEndian.Uint16(buf[1:3]))
+	if n != len(buf)-frameHeaderLen {
+		return f, errFrameLength
+	}
+	return frame{cmd: buf[0], data: buf[frameHeaderLen:]}, nil
+}
+
+func (f frame) isResponse() bool {
+	return f.cmd&cmdResponse != 0
+}
+
+func (f frame) isError() bool {
+	return f.cmd == cmdError
+}
+
+// command returns the command this frame is, or answers. Errors do not
+// identify the command they answer.
+func (f frame) command() byte {
+	if f.isError() {
+		return cmdError
+	}
+	return f.cmd &^ cmdResponse
+}
+
+// errorCode returns the device error code carried by an error response.
+func (f frame) errorCode() (byte, bool) {
+	if !f.isError() || len(f.data) < 1 {
+		return 0, false
+	}
+	return f.data[0], true
+}
+
+func commandName(cmd byte) string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(0x%02x)", cmd)
+}
+
+func errorName(code byte) string {
+	if name, ok := errorNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(0x%02x)", code)
+}
+
+func (f frame) String() string {
+	name := commandName(f.command())
+	if f.isError() {
+		code, _ := f.errorCode()
+		return fmt.Sprintf("%s %s", name, errorName(code))
+	} else if f.isResponse() {
+		name += " response"
+	}
+	return fmt.Sprintf("%s (0x%02x) len=%d", name, f.cmd, len(f.data))
+}
+
+// sessionID returns the session a frame belongs to, for those frames
+// that carry one in the clear.
+func (f frame) sessionID() (byte, bool) {
+	switch f.cmd {
+	case cmdAuthenticateSession, cmdSessionMessage,
+		cmdCreateSession | cmdResponse, cmdSessionMessage | cmdResponse:
+		if len(f.data) > 0 {
+			return f.data[0], true
+		}
+	}
+	return 0, false
+}
+
+// Errors for responses that do not answer the request they were read for.
+var (
+	errStaleResponse     = fmt.Errorf("response to an earlier command")
+	errMalformedResponse = fmt.Errorf("malformed response")
+)
+
+// checkResponse verifies that resp answers req: either as CMD | 0x80 or
+// as an error, and with a LEN field consistent with the data read.
+func checkResponse(req []byte, resp []byte) error {
+	f, err := parseFrame(resp)
+	if err != nil {
+		return errMalformedResponse
+	}
+	if f.isError() {
+		if len(f.data) != 1 {
+			return errMalformedResponse
+		}
+		return nil
+	}
+	if !f.isResponse() {
+		return errMalformedResponse
+	}
+	if len(req) == 0 || f.cmd != req[0]|cmdResponse {
+		return errStaleResponse
+	}
+	return nil
+}
+
+// validateRequest checks that buf is a well formed command frame, for a
+// command the device knows unless allowUnknown is set.
+func validateRequest(buf []byte, allowUnknown bool) error {
+	if len(buf) < frameHeaderLen {
+		return errFrameShort
+	}
+	n := int(binary.BigEndian.Uint16(buf[1:3]))
+	if n != len(buf)-frameHeaderLen {
+		return fmt.Errorf("%w: LEN is %d, but %d bytes of data follow",
+			errFrameLength, n, len(buf)-frameHeaderLen)
+	}
+	if _, known := commandNames[buf[0]]; allowUnknown || (known && buf[0] != cmdError) {
+		return nil
+	}
+	return fmt.Errorf("unknown command 0x%02x", buf[0])
+}
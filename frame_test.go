@@ -0,0 +1,171 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type parseFrameTest struct {
+	buf []byte
+	cmd byte
+	err error
+}
+
+var parseFrameTests = []parseFrameTest{
+	{[]byte{0x01, 0x00, 0x02, 0xca, 0xfe}, cmdEcho, nil},
+	{[]byte{0x06, 0x00, 0x00}, cmdDeviceInfo, nil},
+	{[]byte{0x7f, 0x00, 0x01, 0x03}, cmdError, nil},
+	{[]byte{0x01, 0x00}, 0, errFrameShort},
+	{[]byte{0x01, 0x00, 0x03, 0xca, 0xfe}, 0, errFrameLength},
+	{[]byte{0x01, 0x00, 0x01, 0xca, 0xfe}, 0, errFrameLength},
+}
+
+func TestParseFrame(t *testing.T) {
+	for i, test := range parseFrameTests {
+		f, err := parseFrame(test.buf)
+		if err != test.err {
+			t.Fatalf("parseFrameTest %d: got %v: expected %v", i, err, test.err)
+		} else if err == nil && f.command() != test.cmd {
+			t.Fatalf("parseFrameTest %d: got 0x%02x: expected 0x%02x", i, f.command(), test.cmd)
+		}
+	}
+}
+
+func TestFrameFromLogLine(t *testing.T) {
+	want := []byte{0x06, 0x00, 0x00}
+	lines := []string{
+		`time="2022-05-10T10:00:00Z" level=debug msg="usb endpoint write" Correlation-ID=x buf="[6 0 0]" err="<nil>" len=3 n=3`,
+		`{"Correlation-ID":"x","buf":"BgAA","err":null,"len":3,"level":"debug","msg":"usb endpoint write","n":3}`,
+	}
+	for i, line := range lines {
+		buf, ok := frameFromLogLine(line)
+		if !ok || !bytes.Equal(buf, want) {
+			t.Fatalf("line %d: got %x, %v: expected %x", i, buf, ok, want)
+		}
+	}
+	if _, ok := frameFromLogLine(`level=info msg="handled request"`); ok {
+		t.Fatalf("unrelated log line was decoded")
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	in := `{"time":"2022-05-10T10:00:00Z","request":"03000a00010102030405060708","response":"8300110001020304050607081112131415161718"}
+7f000103
+`
+	var out bytes.Buffer
+	if err := decodeStream(&out, strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"key_id:", "session_id:", "card_challenge:", "INVALID_SESSION"} {
+		if !strings.Contains(out.String(), s) {
+			t.Fatalf("output %q does not contain %q", out.String(), s)
+		}
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	echo := []byte{0x01, 0x00, 0x01, 0xaa}
+	tests := []struct {
+		resp []byte
+		err  error
+	}{
+		{[]byte{0x81, 0x00, 0x01, 0xaa}, nil},
+		{[]byte{0x7f, 0x00, 0x01, 0x03}, nil},
+		{[]byte{0x86, 0x00, 0x01, 0xaa}, errStaleResponse},
+		{[]byte{0x81, 0x00, 0x05, 0xaa}, errMalformedResponse},
+		{[]byte{0x01, 0x00, 0x01, 0xaa}, errMalformedResponse},
+		{[]byte{0x7f, 0x00, 0x00}, errMalformedResponse},
+		{[]byte{}, errMalformedResponse},
+	}
+	for i, test := range tests {
+		if err := checkResponse(echo, test.resp); err != test.err {
+			t.Fatalf("test %d: got %v: expected %v", i, err, test.err)
+		}
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	info := []byte{0x06, 0x00, 0x00}
+	stale := []byte{0x81, 0x00, 0x01, 0xaa}
+	answer := []byte{0x86, 0x00, 0x01, 0x02}
+
+	reads := func(frames ...[]byte) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			f := frames[0]
+			frames = frames[1:]
+			return f, nil
+		}
+	}
+
+	resp, err := readResponse("test", info, reads(stale, answer))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(resp, answer) {
+		t.Fatalf("got %x: expected %x", resp, answer)
+	}
+	if _, err = readResponse("test", info, reads(stale, stale, stale, answer)); err != errDesync {
+		t.Fatalf("got %v: expected %v", err, errDesync)
+	}
+	if _, err = readResponse("test", info, reads([]byte{0x86, 0x00})); err != errDesync {
+		t.Fatalf("got %v: expected %v", err, errDesync)
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		buf          []byte
+		allowUnknown bool
+		ok           bool
+	}{
+		{[]byte{0x06, 0x00, 0x00}, false, true},
+		{[]byte{0x01, 0x00, 0x02, 0xca, 0xfe}, false, true},
+		{[]byte{0x01, 0x00, 0x01, 0xca, 0xfe}, false, false},
+		{[]byte{0x01, 0x00, 0x03, 0xca, 0xfe}, false, false},
+		{[]byte{0x7f, 0x00, 0x00}, false, false},
+		{[]byte{0x86, 0x00, 0x00}, false, false},
+		{[]byte{0x20, 0x00, 0x00}, false, false},
+		{[]byte{0x20, 0x00, 0x00}, true, true},
+		{[]byte{0x20, 0x00, 0x01}, true, false},
+	}
+	for i, test := range tests {
+		if err := validateRequest(test.buf, test.allowUnknown); (err == nil) != test.ok {
+			t.Fatalf("test %d: got %v: expected ok %v", i, err, test.ok)
+		}
+	}
+}
+
+func TestSplitFrames(t *testing.T) {
+	tests := []struct {
+		buf    []byte
+		frames int
+	}{
+		{[]byte{0x06, 0x00, 0x00}, 1},
+		{[]byte{0x01, 0x00, 0x02, 0xca, 0xfe, 0x06, 0x00, 0x00}, 2},
+		{[]byte{}, 0},
+		{[]byte{0x06, 0x00, 0x00, 0x01, 0x00}, 0},
+		{[]byte{0x06, 0x00, 0x00, 0x01, 0x00, 0x02, 0xca}, 0},
+		{[]byte{0x06, 0x00, 0x00, 0x20, 0x00, 0x00}, 0},
+		{bytes.Repeat([]byte{0x06, 0x00, 0x00}, maxBatchFrames+1), 0},
+	}
+	for i, test := range tests {
+		frames, err := splitFrames(test.buf, false)
+		if len(frames) != test.frames || (err == nil) != (test.frames > 0) {
+			t.Fatalf("test %d: got %d frames, %v: expected %d", i, len(frames), err, test.frames)
+		}
+	}
+}
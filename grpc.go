@@ -0,0 +1,386 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Yubico/yubihsm-connector/connectorpb"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// connectorServer serves the API over gRPC, see connectorpb/connector.proto.
+type connectorServer struct {
+	connectorpb.UnimplementedConnectorServer
+}
+
+// newGRPCServer returns a gRPC server. With a certificate it speaks TLS,
+// and with a clientCA as well it requires client certificates issued by
+// it.
+func newGRPCServer(cert *liveCert, clientCA string) (*grpc.Server, error) {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamInterceptor),
+		// Leave room for the message framing around the largest frame.
+		grpc.MaxRecvMsgSize(max_len + 64),
+	}
+
+	if cert != nil {
+		config := serverTLS.config()
+		config.GetCertificate = cert.get
+		if config.MinVersion == 0 {
+			config.MinVersion = tls.VersionTLS12
+		}
+		if clientCA != "" {
+			pem, err := os.ReadFile(clientCA)
+			if err != nil {
+				return nil, err
+			}
+			config.ClientCAs = x509.NewCertPool()
+			if !config.ClientCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", clientCA)
+			}
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
+	}
+
+	s := grpc.NewServer(opts...)
+	connectorpb.RegisterConnectorServer(s, &connectorServer{})
+	return s, nil
+}
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID of the gRPC call in ctx.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// metadataCarrier lets trace context propagate through gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// grpcRequest is middlewareWrapper for gRPC calls: it assigns a request
+// ID, attributes the call to a client and applies the client's limits.
+// Unless the call is refused, done must be called with its outcome.
+func grpcRequest(ctx context.Context, method string, setHeader func(metadata.MD) error) (_ context.Context, done func(error), err error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var id string
+	if ids := md.Get("x-request-id"); len(ids) > 0 && ids[0] != "" {
+		id = ids[0]
+		ctx = withClientRequestID(ctx)
+	} else if id, err = uuidv4(); err != nil {
+		id = "-"
+	}
+	setHeader(metadata.Pairs("x-request-id", id))
+
+	ip := "-"
+	var chains [][]*x509.Certificate
+	if p, ok := peer.FromContext(ctx); ok {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			chains = info.State.VerifiedChains
+		}
+	}
+	var token string
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		token = parseBearer(auth[0])
+	}
+
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	ctx, span := tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("yubihsm.request_id", id),
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", method),
+			attribute.String("client.address", ip),
+		))
+
+	pol := activePolicy.Load()
+	client := pol.identifyCredentials(token, chains, nil, ip)
+	clog := log.WithFields(log.Fields{
+		"X-Request-ID": id,
+		"X-Real-IP":    ip,
+		"Method":       method,
+		"client":       client.id,
+	})
+
+	release, retryAfter, ok := pol.limits.admit(client)
+	if !ok {
+		clog.Warn("client over limits")
+		audit("rate-limited", log.Fields{
+			"X-Request-ID": id,
+			"X-Real-IP":    ip,
+			"client":       client.id,
+			"policy":       client.entry.Name,
+			"URI":          method,
+		})
+		span.End()
+		return nil, nil, status.Errorf(codes.ResourceExhausted, "client over limits, retry after %s", retryAfter)
+	}
+
+	ctx = withIdentity(context.WithValue(ctx, requestIDKey{}, id), client)
+	now := time.Now()
+	return ctx, func(err error) {
+		release()
+
+		code := status.Code(err)
+		fields := log.Fields{
+			"latency": time.Since(now),
+			"code":    code,
+		}
+		span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(code)))
+		if err != nil {
+			span.SetStatus(otelcodes.Error, err.Error())
+			clog.WithFields(fields).WithError(err).Error("error in handling request")
+		} else {
+			clog.WithFields(fields).Info("handled request")
+		}
+		span.End()
+	}, nil
+}
+
+func grpcUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	ctx, done, err := grpcRequest(ctx, info.FullMethod, func(md metadata.MD) error {
+		return grpc.SetHeader(ctx, md)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			log.WithField("panic", rcv).Error("recovered from handler panic")
+			err = status.Error(codes.Internal, "internal error")
+		}
+		done(err)
+	}()
+
+	return handler(ctx, req)
+}
+
+// contextStream is a server stream with the context from grpcRequest.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, done, err := grpcRequest(ss.Context(), info.FullMethod, ss.SetHeader)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			log.WithField("panic", rcv).Error("recovered from handler panic")
+			err = status.Error(codes.Internal, "internal error")
+		}
+		done(err)
+	}()
+
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// grpcError maps an error from the device, or from waiting for it, to a
+// gRPC status.
+func grpcError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, errQueueFull), errors.Is(err, errQueueTimeout), errors.Is(err, errDraining):
+		code = codes.Unavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, errDesync):
+		// The command may or may not have run.
+		code = codes.Aborted
+	}
+	return status.Error(code, err.Error())
+}
+
+// exchange runs a single frame, subject to the same checks as one sent
+// to apiHandler. Retries under a client supplied request ID are answered
+// from responseCache, like those sent to apiHandler.
+func (s *connectorServer) exchange(ctx context.Context, req []byte, cid string) ([]byte, error) {
+	if len(req) < min_len || len(req) > max_len {
+		return nil, status.Errorf(codes.InvalidArgument, "frame length %d out of bounds", len(req))
+	}
+	if err := validateRequest(req, allowUnknownCommands); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var resp []byte
+	var proxyErr error
+	if responseCache != nil && hasClientRequestID(ctx) && len(cid) <= maxRequestIDLen {
+		key := identityFrom(ctx).id + " " + cid
+		cached, entry, err := responseCache.begin(ctx, key, req)
+		switch {
+		case errors.Is(err, errIdempotencyConflict):
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		case errors.Is(err, errIdempotencyUnknown):
+			return nil, status.Error(codes.Aborted, err.Error())
+		case err != nil:
+			return nil, status.Error(codes.Unavailable, "gave up waiting for original request")
+		case cached != nil:
+			return cached, nil
+		case entry != nil:
+			// As in apiHandler, carry on should the client go away.
+			ctx = context.WithoutCancel(ctx)
+			defer func() { responseCache.finish(key, entry, resp, proxyErr) }()
+		}
+	}
+
+	if maxRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxRequestTimeout)
+		defer cancel()
+	}
+
+	resp, proxyErr = deviceProxy(ctx, req, cid, currentSerial())
+	if proxyErr != nil {
+		return nil, grpcError(proxyErr)
+	}
+	if err := rec.record(req, resp); err != nil {
+		log.WithField("X-Request-ID", cid).WithError(err).Warn("failed recording exchange")
+	}
+	sockets.observe(nil, req, resp)
+	return resp, nil
+}
+
+func (s *connectorServer) Exchange(ctx context.Context, req *connectorpb.ExchangeRequest) (*connectorpb.ExchangeResponse, error) {
+	resp, err := s.exchange(ctx, req.GetFrame(), requestIDFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return &connectorpb.ExchangeResponse{Frame: resp}, nil
+}
+
+// ExchangeStream answers frames in order. The stream as a whole counts
+// against the client's in-flight requests, and each frame against its
+// rate.
+func (s *connectorServer) ExchangeStream(stream connectorpb.Connector_ExchangeStreamServer) error {
+	ctx := stream.Context()
+	cid := requestIDFrom(ctx)
+	client := identityFrom(ctx)
+
+	for seq := 0; ; seq++ {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		mcid := fmt.Sprintf("%s/%d", cid, seq)
+		if retryAfter, ok := activePolicy.Load().limits.allow(client); !ok {
+			audit("rate-limited", log.Fields{
+				"X-Request-ID": mcid,
+				"client":       client.id,
+				"policy":       client.entry.Name,
+				"URI":          connectorpb.Connector_ExchangeStream_FullMethodName,
+			})
+			return status.Errorf(codes.ResourceExhausted, "client over limits, retry after %s", retryAfter)
+		}
+
+		resp, err := s.exchange(ctx, req.GetFrame(), mcid)
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(&connectorpb.ExchangeResponse{Frame: resp}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *connectorServer) Status(ctx context.Context, req *connectorpb.StatusRequest) (*connectorpb.StatusResponse, error) {
+	cid := requestIDFrom(ctx)
+	serial := currentSerial()
+
+	resp := &connectorpb.StatusResponse{
+		Status:  "OK",
+		Serial:  serial,
+		Version: Version.String(),
+		Pid:     int32(os.Getpid()),
+	}
+	if err := deviceCheck(ctx, cid, serial); err != nil {
+		resp.Status = "NO_DEVICE"
+		log.WithField("X-Request-ID", cid).WithError(err).Warn("status failed to open usb device")
+	}
+	if serial == "" {
+		resp.Serial = "*"
+	}
+	depth, _ := deviceScheduler.stats()
+	resp.QueueDepth = int32(depth)
+	return resp, nil
+}
+
+func (s *connectorServer) ListDevices(ctx context.Context, req *connectorpb.ListDevicesRequest) (*connectorpb.ListDevicesResponse, error) {
+	serials, err := deviceList(ctx, requestIDFrom(ctx))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &connectorpb.ListDevicesResponse{}
+	for _, serial := range serials {
+		resp.Devices = append(resp.Devices, &connectorpb.Device{Serial: serial})
+	}
+	return resp, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Yubico/yubihsm-connector/connectorpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCExchange(t *testing.T) {
+	defer func(proxy func(context.Context, []byte, string, string) ([]byte, error)) {
+		deviceProxy = proxy
+	}(deviceProxy)
+	var cids []string
+	deviceProxy = func(ctx context.Context, req []byte, cid string, serial string) ([]byte, error) {
+		cids = append(cids, cid)
+		return append([]byte{req[0] | cmdResponse}, req[1:]...), nil
+	}
+
+	srv, err := newGRPCServer(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := bufconn.Listen(1 << 16)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := connectorpb.NewConnectorClient(conn)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-request-id", "abc")
+	var header metadata.MD
+	resp, err := client.Exchange(ctx, &connectorpb.ExchangeRequest{Frame: []byte{cmdEcho, 0x00, 0x01, 0xaa}},
+		grpc.Header(&header))
+	if err != nil || !bytes.Equal(resp.GetFrame(), []byte{0x81, 0x00, 0x01, 0xaa}) {
+		t.Fatalf("got %x, %v", resp.GetFrame(), err)
+	}
+	if id := header.Get("x-request-id"); len(id) != 1 || id[0] != "abc" || cids[0] != "abc" {
+		t.Fatalf("got request ID %v, %v: expected abc", id, cids)
+	}
+
+	_, err = client.Exchange(ctx, &connectorpb.ExchangeRequest{Frame: []byte{cmdEcho, 0x00, 0x02, 0xaa}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got %v: expected %v", err, codes.InvalidArgument)
+	}
+
+	stream, err := client.ExchangeStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(0); i < 3; i++ {
+		if err = stream.Send(&connectorpb.ExchangeRequest{Frame: []byte{cmdEcho, 0x00, 0x01, i}}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := stream.Recv()
+		if err != nil || !bytes.Equal(resp.GetFrame(), []byte{0x81, 0x00, 0x01, i}) {
+			t.Fatalf("frame %d: got %x, %v", i, resp.GetFrame(), err)
+		}
+	}
+	stream.CloseSend()
+	if cids[len(cids)-1] != "abc/2" {
+		t.Fatalf("got request ID %q: expected abc/2", cids[len(cids)-1])
+	}
+}
+
+func TestGRPCExchangeRetries(t *testing.T) {
+	defer func(c *idempotencyCache) { responseCache = c }(responseCache)
+	responseCache = newIdempotencyCache(time.Minute)
+
+	var sent int
+	var fail error
+	stubDevice(t, func(req []byte) ([]byte, error) {
+		sent++
+		if fail != nil {
+			return nil, fail
+		}
+		return echoDevice(req)
+	})
+
+	s := &connectorServer{}
+	frame := []byte{0x01, 0x00, 0x02, 0xca, 0xfe}
+	for _, test := range []struct {
+		id   string
+		req  []byte
+		fail error
+		code codes.Code
+		sent int
+	}{
+		{"a", frame, errQueueFull, codes.Unavailable, 1},
+		{"a", frame, nil, codes.OK, 2},
+		{"a", frame, nil, codes.OK, 2},
+		{"a", []byte{0x01, 0x00, 0x01, 0x00}, nil, codes.AlreadyExists, 2},
+		{"b", frame, errDesync, codes.Aborted, 3},
+		{"b", frame, nil, codes.Aborted, 3},
+	} {
+		fail = test.fail
+		ctx := withClientRequestID(context.Background())
+		resp, err := s.exchange(ctx, test.req, test.id)
+		if status.Code(err) != test.code || sent != test.sent {
+			t.Fatalf("%s: got %v after %d sent: expected %v after %d", test.id, err, sent, test.code, test.sent)
+		}
+		if want, _ := echoDevice(test.req); err == nil && !bytes.Equal(resp, want) {
+			t.Fatalf("%s: got %x: expected %x", test.id, resp, want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// responseCache remembers device responses by client supplied request ID
+// for a short while, so that a client retrying a request after timing out
+// gets the original response instead of running the command twice. Nil
+// when disabled.
+var responseCache *idempotencyCache
+
+var (
+	errIdempotencyConflict = fmt.Errorf("request ID reused with a different body")
+	errIdempotencyUnknown  = fmt.Errorf("earlier request with this ID failed, and may have run on the device")
+)
+
+// Bounds on what is remembered, to keep clients from exhausting memory.
+const (
+	maxIdempotentEntries = 4096
+	maxRequestIDLen      = 128
+)
+
+var idempotentRequests = newCounter("yubihsm_connector_idempotent_requests_total",
+	"Requests answered from or refused by the response cache.", "result")
+
+type idempotencyCache struct {
+	mtx     sync.Mutex
+	ttl     time.Duration
+	entries map[string]*idempotentEntry
+	swept   time.Time
+}
+
+type idempotentEntry struct {
+	sum  [sha256.Size]byte
+	done chan struct{}
+	// Set before done is closed. Without a response, the request failed
+	// at a point where it may or may not have run on the device.
+	resp    []byte
+	unknown bool
+	expires time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		entries: map[string]*idempotentEntry{},
+		swept:   time.Now(),
+	}
+}
+
+func (e *idempotentEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// begin looks up the request body under key. If an earlier request with
+// the same body has completed, its response is returned. If it is still
+// in progress, begin waits for it. Otherwise the caller is handed a new
+// entry, which it must finish. Neither is returned when the cache is
+// full, and the request should go ahead uncached.
+func (c *idempotencyCache) begin(ctx context.Context, key string, body []byte) (resp []byte, e *idempotentEntry, err error) {
+	sum := sha256.Sum256(body)
+
+	for {
+		c.mtx.Lock()
+		now := time.Now()
+		if now.Sub(c.swept) > c.ttl {
+			for k, x := range c.entries {
+				if x.expired(now) {
+					delete(c.entries, k)
+				}
+			}
+			c.swept = now
+		}
+
+		e, found := c.entries[key]
+		if !found || e.expired(now) {
+			if !found && len(c.entries) >= maxIdempotentEntries {
+				c.mtx.Unlock()
+				return nil, nil, nil
+			}
+			e = &idempotentEntry{sum: sum, done: make(chan struct{})}
+			c.entries[key] = e
+			c.mtx.Unlock()
+			return nil, e, nil
+		}
+		c.mtx.Unlock()
+
+		if e.sum != sum {
+			idempotentRequests.inc("conflict")
+			return nil, nil, errIdempotencyConflict
+		}
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if e.resp != nil {
+			idempotentRequests.inc("replayed")
+			return e.resp, nil, nil
+		}
+		if e.unknown {
+			idempotentRequests.inc("unknown")
+			return nil, nil, errIdempotencyUnknown
+		}
+		// The earlier request never reached the device and has been
+		// forgotten, so this one gets to try again.
+	}
+}
+
+// finish records the outcome of the request that was handed e: its
+// response, or the error it failed with. Requests shed before reaching
+// the device are forgotten, to be tried again. Any other failure may
+// have come after the device ran the command, say a deadline passing
+// while waiting for its answer, so retries are refused rather than
+// risking running it twice.
+func (c *idempotencyCache) finish(key string, e *idempotentEntry, resp []byte, err error) {
+	c.mtx.Lock()
+	switch {
+	case err == nil && resp != nil:
+		e.resp = resp
+		e.expires = time.Now().Add(c.ttl)
+	case errors.Is(err, errQueueFull), errors.Is(err, errQueueTimeout), errors.Is(err, errDraining):
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+	default:
+		e.unknown = true
+		e.expires = time.Now().Add(c.ttl)
+	}
+	c.mtx.Unlock()
+	close(e.done)
+}
+
+type clientRequestIDKey struct{}
+
+// withClientRequestID marks the request ID as chosen by the client, as
+// opposed to one we made up, and so meaningful across retries.
+func withClientRequestID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, clientRequestIDKey{}, true)
+}
+
+func hasClientRequestID(ctx context.Context) bool {
+	ok, _ := ctx.Value(clientRequestIDKey{}).(bool)
+	return ok
+}
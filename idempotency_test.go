@@ -0,0 +1,76 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	c := newIdempotencyCache(time.Minute)
+	ctx := context.Background()
+	req := []byte{0x01, 0x00, 0x01, 0xaa}
+
+	resp, e, err := c.begin(ctx, "a", req)
+	if err != nil || resp != nil || e == nil {
+		t.Fatalf("first request: got %v, %v, %v", resp, e, err)
+	}
+
+	// A retry arriving while the original is in flight waits for it.
+	done := make(chan []byte)
+	go func() {
+		resp, _, _ := c.begin(ctx, "a", req)
+		done <- resp
+	}()
+	c.finish("a", e, []byte{0x81, 0x00, 0x01, 0xaa}, nil)
+	if resp := <-done; !bytes.Equal(resp, []byte{0x81, 0x00, 0x01, 0xaa}) {
+		t.Fatalf("retry got %x", resp)
+	}
+
+	if _, _, err = c.begin(ctx, "a", []byte{0x01, 0x00, 0x01, 0xbb}); err != errIdempotencyConflict {
+		t.Fatalf("conflicting body: got %v", err)
+	}
+	if _, e, _ = c.begin(ctx, "b", req); e == nil {
+		t.Fatal("other ID should not be answered from the cache")
+	}
+
+	// Shed requests are forgotten, and may be tried again.
+	c.finish("b", e, nil, errQueueFull)
+	if resp, e, _ = c.begin(ctx, "b", req); resp != nil || e == nil {
+		t.Fatalf("after shedding: got %v, %v", resp, e)
+	}
+
+	// Others may have run, and are not.
+	c.finish("b", e, nil, context.DeadlineExceeded)
+	if resp, e, err = c.begin(ctx, "b", req); err != errIdempotencyUnknown {
+		t.Fatalf("after failure: got %v, %v, %v", resp, e, err)
+	}
+}
+
+func TestIdempotencyCacheExpiry(t *testing.T) {
+	c := newIdempotencyCache(time.Millisecond)
+	ctx := context.Background()
+
+	_, e, _ := c.begin(ctx, "a", []byte{1})
+	c.finish("a", e, []byte{2}, nil)
+	time.Sleep(5 * time.Millisecond)
+
+	if resp, e, err := c.begin(ctx, "a", []byte{3}); err != nil || resp != nil || e == nil {
+		t.Fatalf("expired entry: got %v, %v, %v", resp, e, err)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// listenerConfig is an address the API is served on, and how. Without a
+// list of listeners in the configuration, the listen, cert and key and
+// related settings make up a single one.
+type listenerConfig struct {
+	Listen     string `mapstructure:"listen"`
+	certSource `mapstructure:",squash"`
+	// CA certificates client certificates must be issued by, requiring
+	// them.
+	ClientCA string `mapstructure:"client-ca"`
+	// Credentials of which at least one must be presented, see
+	// authorized. Any client is let in without.
+	Auth []string `mapstructure:"auth"`
+	// Routes served, by name, see routeNames. All of them without.
+	Routes []string `mapstructure:"routes"`
+	// Host headers accepted. Any host is accepted without.
+	HostAllowlist []string `mapstructure:"host-allowlist"`
+	H2C           bool     `mapstructure:"h2c"`
+	ProxyProtocol bool     `mapstructure:"proxy-protocol"`
+	SocketMode    string   `mapstructure:"socket-mode"`
+	SocketOwner   string   `mapstructure:"socket-owner"`
+
+	socket    socketConfig
+	clientCAs *x509.CertPool
+}
+
+// Routes a listener may serve, by name, and the paths they cover.
+var routeNames = map[string][]string{
+	"api":     {"/connector/api", "/connector/api/batch"},
+	"ws":      {"/connector/ws"},
+	"status":  {"/connector/status"},
+	"metrics": {"/connector/metrics"},
+}
+
+// Credentials a listener may require, see authorized.
+var authNames = []string{"api-key", "client-cert", "peer"}
+
+// loadListeners returns the listeners configured in v.
+func loadListeners(v *viper.Viper) ([]*listenerConfig, error) {
+	var listeners []*listenerConfig
+	if err := v.UnmarshalKey("listeners", &listeners); err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 {
+		l := &listenerConfig{
+			Listen:        v.GetString("listen"),
+			certSource:    certSourceFrom(v),
+			H2C:           v.GetBool("h2c"),
+			ProxyProtocol: v.GetBool("proxy-protocol"),
+			SocketMode:    v.GetString("socket-mode"),
+			SocketOwner:   v.GetString("socket-owner"),
+		}
+		if v.GetBool("enable-host-allowlist") {
+			l.HostAllowlist = v.GetStringSlice("host-allowlist")
+		}
+		listeners = append(listeners, l)
+	}
+
+	seen := map[string]bool{}
+	for i, l := range listeners {
+		if err := l.compile(); err != nil {
+			return nil, fmt.Errorf("listener %d (%s): %w", i, l.Listen, err)
+		}
+		if seen[l.Listen] {
+			return nil, fmt.Errorf("listener %d: %s listed twice", i, l.Listen)
+		}
+		seen[l.Listen] = true
+	}
+	return listeners, nil
+}
+
+func (l *listenerConfig) compile() (err error) {
+	if l.Listen == "" {
+		return fmt.Errorf("no listen address")
+	}
+	if err = l.certSource.validate(); err != nil {
+		return err
+	}
+	if l.ClientCA != "" {
+		if !l.tls() {
+			return fmt.Errorf("client-ca requires cert and key")
+		}
+		pem, err := os.ReadFile(l.ClientCA)
+		if err != nil {
+			return err
+		}
+		l.clientCAs = x509.NewCertPool()
+		if !l.clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", l.ClientCA)
+		}
+	}
+	if l.H2C && !isLoopback(l.Listen) {
+		return fmt.Errorf("h2c is only allowed on a loopback listen address")
+	}
+	if isUnixAddr(l.Listen) {
+		if l.SocketMode == "" {
+			l.SocketMode = "0660"
+		}
+		if l.socket, err = parseSocketConfig(l.SocketMode, l.SocketOwner); err != nil {
+			return err
+		}
+	}
+
+	if len(l.Routes) == 0 {
+		for name := range routeNames {
+			l.Routes = append(l.Routes, name)
+		}
+	}
+	for _, route := range l.Routes {
+		if _, ok := routeNames[route]; !ok {
+			return fmt.Errorf("unknown route %q", route)
+		}
+	}
+next:
+	for _, auth := range l.Auth {
+		for _, name := range authNames {
+			if auth == name {
+				continue next
+			}
+		}
+		return fmt.Errorf("unknown auth %q", auth)
+	}
+	return nil
+}
+
+func (l *listenerConfig) tls() bool {
+	return l.configured()
+}
+
+// liveListener is a listener being served. A reload may swap its auth,
+// host allowlist and certificate while it is, the other settings stay as
+// they were when it started.
+type liveListener struct {
+	config atomic.Pointer[listenerConfig]
+	cert   liveCert
+}
+
+type listenerKey struct{}
+
+// listenerFrom returns the listener a request arrived on, as currently
+// configured. Requests not served by one get the defaults.
+func listenerFrom(ctx context.Context) *listenerConfig {
+	if l, ok := ctx.Value(listenerKey{}).(*liveListener); ok {
+		return l.config.Load()
+	}
+	return &listenerConfig{Listen: viper.GetString("listen")}
+}
+
+// authorized reports whether r, attributed to client, presented any of
+// the credentials the listener requires.
+func (l *listenerConfig) authorized(r *http.Request, client identity) bool {
+	if len(l.Auth) == 0 {
+		return true
+	}
+	for _, auth := range l.Auth {
+		switch auth {
+		case "api-key":
+			if strings.HasPrefix(client.id, "api-key:") {
+				return true
+			}
+		case "client-cert":
+			if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+				return true
+			}
+		case "peer":
+			if cred, _ := unixPeer(r.Context()); cred != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (l *listenerConfig) validHost(host string) bool {
+	return len(l.HostAllowlist) == 0 || validateHost(host, l.HostAllowlist)
+}
+
+// server returns a server for the routes of the listener, and its live
+// settings, loading its certificate if any.
+func (l *listenerConfig) server() (*http.Server, *liveListener, error) {
+	live := &liveListener{}
+	live.cert.name = l.Listen
+	if l.tls() {
+		if err := live.cert.load(l.certSource); err != nil {
+			return nil, nil, err
+		}
+	}
+	live.config.Store(l)
+
+	handlers := map[string]http.HandlerFunc{
+		"/connector/status": func(w http.ResponseWriter, r *http.Request) {
+			statusHandler(w, r, currentSerial())
+		},
+		"/connector/api": func(w http.ResponseWriter, r *http.Request) {
+			apiHandler(w, r, currentSerial())
+		},
+		"/connector/api/batch": func(w http.ResponseWriter, r *http.Request) {
+			batchHandler(w, r, currentSerial())
+		},
+		"/connector/ws": func(w http.ResponseWriter, r *http.Request) {
+			wsHandler(w, r, currentSerial())
+		},
+		"/connector/metrics": metricsHandler,
+	}
+	mux := http.NewServeMux()
+	for _, route := range l.Routes {
+		for _, path := range routeNames[route] {
+			mux.HandleFunc(path, middlewareWrapper(handlers[path]))
+		}
+	}
+
+	srv := &http.Server{
+		Addr:        l.Listen,
+		Handler:     mux,
+		ReadTimeout: 5 * time.Second, // Hard coded 5s timeout to prevent resource starvation
+		ConnContext: connContext,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), listenerKey{}, live)
+		},
+	}
+
+	// HTTP/2 is negotiated over TLS, and may be spoken in the clear (h2c)
+	// when asked for, but only on loopback.
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	srv.Protocols.SetUnencryptedHTTP2(l.H2C)
+
+	if l.tls() {
+		srv.TLSConfig = serverTLS.config()
+		srv.TLSConfig.GetCertificate = live.cert.get
+		if l.clientCAs != nil {
+			srv.TLSConfig.ClientCAs = l.clientCAs
+			srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return srv, live, nil
+}
+
+// listen opens the listener's socket, unless the service manager passed
+// one bound to its address. The socket mode and owner are then up to the
+// service manager.
+func (l *listenerConfig) listen() (ln net.Listener, err error) {
+	if ln = inheritedListener(l.Listen); ln != nil {
+		log.WithField("listen", l.Listen).Debug("using socket passed by the service manager")
+	} else if isUnixAddr(l.Listen) {
+		ln, err = listenUnix(strings.TrimPrefix(l.Listen, unixPrefix), l.socket)
+	} else {
+		ln, err = net.Listen("tcp", l.Listen)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l.ProxyProtocol {
+		ln = &proxyListener{Listener: ln, trusted: trustedProxies}
+	}
+	return ln, nil
+}
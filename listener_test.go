@@ -0,0 +1,95 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func loadTestListeners(t *testing.T, config string) ([]*listenerConfig, error) {
+	return loadListeners(testConfig(t, config))
+}
+
+func TestListenersInvalid(t *testing.T) {
+	for _, config := range []string{
+		"listeners: [{cert: a.crt, key: a.key}]",
+		"listeners: [{listen: \"localhost:1\", cert: a.crt}]",
+		"listeners: [{listen: \"localhost:1\", routes: [nonsense]}]",
+		"listeners: [{listen: \"localhost:1\", auth: [password]}]",
+		"listeners: [{listen: \"0.0.0.0:1\", h2c: true}]",
+		"listeners: [{listen: \"localhost:1\"}, {listen: \"localhost:1\"}]",
+	} {
+		if _, err := loadTestListeners(t, config); err == nil {
+			t.Fatalf("listeners %q were accepted", config)
+		}
+	}
+}
+
+func TestListenerServer(t *testing.T) {
+	listeners, err := loadTestListeners(t, `
+listeners:
+  - listen: "localhost:1"
+    routes: [metrics]
+    auth: [api-key]
+    host-allowlist: [hsm.example.com]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer activePolicy.Store(activePolicy.Load())
+	pol, err := loadTestPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activePolicy.Store(pol)
+
+	srv, _, err := listeners[0].server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.Config.BaseContext = srv.BaseContext
+	ts.Start()
+	defer ts.Close()
+
+	for _, test := range []struct {
+		path   string
+		host   string
+		token  string
+		status int
+	}{
+		{"/connector/metrics", "hsm.example.com", "test", http.StatusOK},
+		{"/connector/metrics", "hsm.example.com", "", http.StatusUnauthorized},
+		{"/connector/metrics", "evil.example.com", "test", http.StatusForbidden},
+		{"/connector/status", "hsm.example.com", "test", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequestWithContext(context.Background(), "GET", ts.URL+test.path, nil)
+		req.Host = test.host
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("%s on %s: got %d: expected %d", test.path, test.host, resp.StatusCode, test.status)
+		}
+	}
+}
@@ -17,6 +17,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -24,6 +25,8 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -35,64 +38,226 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-)
-
-var (
-	// Host header allowlisting
-	hostHeaderAllowlisting bool
-	hostHeaderAllowlist    = []string{"localhost", "localhost.", "127.0.0.1", "[::1]"}
+	"google.golang.org/grpc"
 )
 
 type program struct {
-	srv *http.Server
+	servers       []*http.Server
+	live          []*liveListener
+	sockets       []net.Listener
+	grpcSrv       *grpc.Server
+	grpcCert      *liveCert
+	stopMonitor   context.CancelFunc
+	running       atomic.Bool
+	traceShutdown func(context.Context) error
 }
 
 func (p *program) Start(s service.Service) error {
-	addr := viper.GetString("listen")
-	serial, _ := ensureSerial(viper.GetString("serial"))           // already validated by Cobra
-	p.srv = &http.Server{Addr: addr, ReadTimeout: 5 * time.Second} // Hard coded 5s timeout to prevent resource starvation
-
-	http.HandleFunc("/connector/status", middlewareWrapper(func(w http.ResponseWriter, r *http.Request) {
-		statusHandler(w, r, serial)
-	}))
-	http.HandleFunc("/connector/api", middlewareWrapper(func(w http.ResponseWriter, r *http.Request) {
-		apiHandler(w, r, serial)
-	}))
+	p.running.Store(true)
+	serial, _ := ensureSerial(viper.GetString("serial")) // already validated by Cobra
+	listeners, _ := loadListeners(viper.GetViper())      // already validated by Cobra
+	deviceSerial.Store(serial)
 
 	if viper.GetBool("seccomp") {
 		log.Warn("seccomp support has been deprecated and the flag will be removed in future versions")
 	}
 
-	tls := false
-	cert := viper.GetString("cert")
-	key := viper.GetString("key")
-	if cert != "" && key != "" {
-		tls = true
+	var err error
+	if p.traceShutdown, err = tracingInit(viper.GetString("otel-endpoint"), viper.GetString("otel-file")); err != nil {
+		return err
+	}
+
+	if record := viper.GetString("record"); record != "" {
+		if rec, err = newRecorder(record); err != nil {
+			return err
+		}
+		log.WithField("record", record).Info("recording api exchanges")
 	}
 
 	log.WithFields(log.Fields{
-		"pid":    os.Getpid(),
-		"listen": addr,
-		"TLS":    tls,
+		"pid":             os.Getpid(),
+		"listeners":       len(listeners),
+		"trusted-proxies": viper.GetStringSlice("trusted-proxies"),
 	}).Debug("takeoff")
 
-	go func(tls bool) {
-		if tls {
-			if err := p.srv.ListenAndServeTLS(cert, key); err != nil {
-				log.Errorf("ListenAndServeTLS failure: %s", err)
+	trustedProxies, _ = parseTrustedProxies(viper.GetStringSlice("trusted-proxies")) // already validated by Cobra
+	serverTLS, _ = loadTLSSettings(viper.GetViper())                                 // already validated by Cobra
+	pol, _ := loadPolicy(viper.GetViper())                                           // already validated by Cobra
+	activePolicy.Store(pol)
+	deviceScheduler, _ = loadScheduler(viper.GetViper()) // already validated by Cobra
+	maxRequestTimeout = viper.GetDuration("max-request-timeout")
+	allowUnknownCommands = viper.GetBool("allow-unknown-commands")
+	if window := viper.GetDuration("idempotency-window"); window > 0 {
+		responseCache = newIdempotencyCache(window)
+	}
+	if err = auditInit(viper.GetString("audit-log")); err != nil {
+		return err
+	}
+
+	for _, l := range listeners {
+		srv, live, err := l.server()
+		if err != nil {
+			p.Stop(s)
+			return err
+		}
+		ln, err := l.listen()
+		if err != nil {
+			p.Stop(s)
+			return err
+		}
+		p.servers = append(p.servers, srv)
+		p.live = append(p.live, live)
+		p.sockets = append(p.sockets, ln)
+		if l.tls() {
+			live.cert.watch()
+		}
+
+		log.WithFields(log.Fields{
+			"listen":         l.Listen,
+			"TLS":            l.tls(),
+			"mTLS":           l.ClientCA != "",
+			"routes":         l.Routes,
+			"auth":           l.Auth,
+			"host-allowlist": l.HostAllowlist,
+			"proxy-protocol": l.ProxyProtocol,
+			"h2c":            l.H2C,
+		}).Debug("listening")
+
+		go func(l *listenerConfig) {
+			if l.tls() {
+				// The certificate comes from srv.TLSConfig.
+				if err := srv.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+					log.Errorf("ServeTLS failure: %s", err)
+				}
+			} else {
+				if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+					log.Errorf("Serve failure: %s", err)
+				}
+			}
+		}(l)
+	}
+
+	if grpcAddr := viper.GetString("grpc-listen"); grpcAddr != "" {
+		if src := certSourceFrom(viper.GetViper()); src.configured() {
+			p.grpcCert = &liveCert{name: grpcAddr}
+			if err = p.grpcCert.load(src); err != nil {
+				p.Stop(s)
+				return err
 			}
-		} else {
-			if err := p.srv.ListenAndServe(); err != nil {
-				log.Errorf("ListenAndServe failure: %s", err)
+			p.grpcCert.watch()
+		}
+		if p.grpcSrv, err = newGRPCServer(p.grpcCert, viper.GetString("grpc-client-ca")); err != nil {
+			p.Stop(s)
+			return err
+		}
+		gln := inheritedListener(grpcAddr)
+		if gln == nil {
+			if gln, err = net.Listen("tcp", grpcAddr); err != nil {
+				p.Stop(s)
+				return err
 			}
 		}
-	}(tls)
+		p.sockets = append(p.sockets, gln)
+		log.WithFields(log.Fields{
+			"listen": grpcAddr,
+			"TLS":    p.grpcCert != nil,
+			"mTLS":   viper.GetString("grpc-client-ca") != "",
+		}).Debug("grpc takeoff")
+
+		go func() {
+			if err := p.grpcSrv.Serve(gln); err != nil {
+				log.Errorf("gRPC Serve failure: %s", err)
+			}
+		}()
+	}
+	unusedSockets()
+	if err = upgradeReady(); err != nil {
+		p.Stop(s)
+		return err
+	}
+	p.handleUpgrades()
+	p.handleReloads()
+
+	var ctx context.Context
+	ctx, p.stopMonitor = context.WithCancel(context.Background())
+	serviceNotify(ctx)
 
 	return nil
 }
 
 func (p *program) Stop(s service.Service) error {
-	return p.srv.Shutdown(context.TODO())
+	sdNotify("STOPPING=1")
+	if p.stopMonitor != nil {
+		p.stopMonitor()
+	}
+
+	timeout := viper.GetDuration("drain-timeout")
+	log.WithField("timeout", timeout).Info("draining requests")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Requests waiting for the device are refused, and the one using it
+	// given until the timeout to finish, before the device is closed.
+	deviceScheduler.refuse()
+	err := p.shutdown(ctx)
+	if qerr := deviceScheduler.shutdown(ctx, abortGrace); qerr != nil {
+		// Closing the device under a request still using it isn't safe,
+		// leave that to the process exiting.
+		cid, held, _ := deviceScheduler.holding()
+		log.WithError(qerr).WithFields(log.Fields{
+			"Correlation-ID": cid,
+			"held":           held,
+		}).Warn("device still in use after draining, not closing it")
+	} else {
+		usbclose("Process terminate")
+	}
+
+	if rec != nil {
+		rec.close()
+	}
+	if p.traceShutdown != nil {
+		p.traceShutdown(context.Background())
+	}
+	return err
+}
+
+// shutdown stops the servers accepting requests and waits, until ctx is
+// done, for those in flight. Any still in flight then are cut off. Their
+// certificates are no longer followed.
+func (p *program) shutdown(ctx context.Context) error {
+	var mtx sync.Mutex
+	var err error
+	var wg sync.WaitGroup
+	for _, srv := range p.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if serr := srv.Shutdown(ctx); serr != nil {
+				srv.Close()
+				mtx.Lock()
+				err = serr
+				mtx.Unlock()
+			}
+		}()
+	}
+	if p.grpcSrv != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stop := context.AfterFunc(ctx, p.grpcSrv.Stop)
+			defer stop()
+			p.grpcSrv.GracefulStop()
+		}()
+	}
+	wg.Wait()
+
+	for _, live := range p.live {
+		live.cert.unwatch()
+	}
+	if p.grpcCert != nil {
+		p.grpcCert.unwatch()
+	}
+	return err
 }
 
 //go:generate go run version.in.go
@@ -129,6 +294,12 @@ func main() {
 	go func() {
 		signalEncountered := <-signalChannel
 		log.Info("Shutting down.")
+		if prg.running.Load() {
+			// The service stops on the same signal, draining requests
+			// first; another one cuts that short.
+			<-signalChannel
+			log.Warn("Draining cut short.")
+		}
 
 		// Put any process wide shutdown calls here
 		usbclose("Process terminate")
@@ -165,17 +336,10 @@ func main() {
 				}
 			}
 
-			certkeyErr := fmt.Errorf("cert and key must both be specified")
-			if viper.GetString("cert") != "" && viper.GetString("key") == "" {
-				return certkeyErr
-			} else if viper.GetString("cert") == "" && viper.GetString("key") != "" {
-				return certkeyErr
-			}
-
-			serial, err := ensureSerial(viper.GetString("serial"))
-			if err != nil {
+			if err = validateConfig(viper.GetViper()); err != nil {
 				return err
 			}
+			serial, _ := ensureSerial(viper.GetString("serial"))
 
 			log.WithFields(log.Fields{
 				"config":  viper.ConfigFileUsed(),
@@ -196,29 +360,85 @@ func main() {
 		},
 	}
 	rootCmd.PersistentFlags().StringP("config", "c", "", "config file")
-	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
+	bindFlag("config", rootCmd.PersistentFlags().Lookup("config"))
 	rootCmd.PersistentFlags().StringP("log-level", "", "", "Log level. Available options: trace, debug, info, warn, error, fatal, panic.")
-	viper.BindPFlag("log-level", rootCmd.PersistentFlags().Lookup("log-level"))
+	bindFlag("log-level", rootCmd.PersistentFlags().Lookup("log-level"))
 	rootCmd.PersistentFlags().BoolP("debug", "d", false, "(Deprecated) debug output. This flag is deprecated, please use --log-level=debug instead")
-	viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug"))
+	bindFlag("debug", rootCmd.PersistentFlags().Lookup("debug"))
 	rootCmd.PersistentFlags().BoolP("seccomp", "s", false, "enable seccomp")
-	viper.BindPFlag("seccomp", rootCmd.PersistentFlags().Lookup("seccomp"))
+	bindFlag("seccomp", rootCmd.PersistentFlags().Lookup("seccomp"))
 	rootCmd.PersistentFlags().StringP("cert", "", "", "certificate (X509)")
-	viper.BindPFlag("cert", rootCmd.PersistentFlags().Lookup("cert"))
+	bindFlag("cert", rootCmd.PersistentFlags().Lookup("cert"))
 	rootCmd.PersistentFlags().StringP("key", "", "", "certificate key")
-	viper.BindPFlag("key", rootCmd.PersistentFlags().Lookup("key"))
+	bindFlag("key", rootCmd.PersistentFlags().Lookup("key"))
+	rootCmd.PersistentFlags().StringP("pkcs12", "", "", "PKCS#12 bundle with the certificate and key, instead of cert and key")
+	bindFlag("pkcs12", rootCmd.PersistentFlags().Lookup("pkcs12"))
+	rootCmd.PersistentFlags().StringP("key-passphrase-file", "", "", "file with the passphrase the key or PKCS#12 bundle is encrypted with")
+	bindFlag("key-passphrase-file", rootCmd.PersistentFlags().Lookup("key-passphrase-file"))
+	rootCmd.PersistentFlags().StringP("key-passphrase-env", "", "", "environment variable with the passphrase the key or PKCS#12 bundle is encrypted with")
+	bindFlag("key-passphrase-env", rootCmd.PersistentFlags().Lookup("key-passphrase-env"))
+	rootCmd.PersistentFlags().StringP("key-passphrase-credential", "", "", "systemd credential with the passphrase the key or PKCS#12 bundle is encrypted with")
+	bindFlag("key-passphrase-credential", rootCmd.PersistentFlags().Lookup("key-passphrase-credential"))
 	rootCmd.PersistentFlags().StringP("serial", "", "", "device serial")
-	viper.BindPFlag("serial", rootCmd.PersistentFlags().Lookup("serial"))
+	bindFlag("serial", rootCmd.PersistentFlags().Lookup("serial"))
 	rootCmd.PersistentFlags().StringP("listen", "l", "localhost:12345", "listen address")
-	viper.BindPFlag("listen", rootCmd.PersistentFlags().Lookup("listen"))
+	bindFlag("listen", rootCmd.PersistentFlags().Lookup("listen"))
 	rootCmd.PersistentFlags().BoolP("syslog", "L", false, "log to syslog/eventlog")
-	viper.BindPFlag("syslog", rootCmd.PersistentFlags().Lookup("syslog"))
-	rootCmd.PersistentFlags().BoolVar(&hostHeaderAllowlisting, "enable-host-header-allowlist", false, "Enable Host header allowlisting")
-	viper.BindPFlag("enable-host-allowlist", rootCmd.PersistentFlags().Lookup("enable-host-header-allowlist"))
-	rootCmd.PersistentFlags().StringSliceVar(&hostHeaderAllowlist, "host-header-allowlist", hostHeaderAllowlist, "Host header allowlist")
-	viper.BindPFlag("host-allowlist", rootCmd.PersistentFlags().Lookup("host-header-allowlist"))
+	bindFlag("syslog", rootCmd.PersistentFlags().Lookup("syslog"))
+	rootCmd.PersistentFlags().Bool("enable-host-header-allowlist", false, "Enable Host header allowlisting")
+	bindFlag("enable-host-allowlist", rootCmd.PersistentFlags().Lookup("enable-host-header-allowlist"))
+	rootCmd.PersistentFlags().StringSlice("host-header-allowlist", []string{"localhost", "localhost.", "127.0.0.1", "[::1]"}, "Host header allowlist")
+	bindFlag("host-allowlist", rootCmd.PersistentFlags().Lookup("host-header-allowlist"))
+	rootCmd.PersistentFlags().String("tls-profile", "", "TLS settings to start from: modern, compatible or fips-approved (default none, Go's defaults)")
+	bindFlag("tls-profile", rootCmd.PersistentFlags().Lookup("tls-profile"))
+	rootCmd.PersistentFlags().String("tls-min-version", "", "lowest TLS version allowed: 1.0, 1.1, 1.2 or 1.3")
+	bindFlag("tls-min-version", rootCmd.PersistentFlags().Lookup("tls-min-version"))
+	rootCmd.PersistentFlags().String("tls-max-version", "", "highest TLS version allowed: 1.0, 1.1, 1.2 or 1.3")
+	bindFlag("tls-max-version", rootCmd.PersistentFlags().Lookup("tls-max-version"))
+	rootCmd.PersistentFlags().StringSlice("tls-cipher-suites", nil, "TLS 1.2 cipher suites allowed, by IANA name")
+	bindFlag("tls-cipher-suites", rootCmd.PersistentFlags().Lookup("tls-cipher-suites"))
+	rootCmd.PersistentFlags().StringSlice("tls-curves", nil, "TLS key exchanges allowed, in order of preference: X25519, X25519MLKEM768, P-256, P-384 or P-521")
+	bindFlag("tls-curves", rootCmd.PersistentFlags().Lookup("tls-curves"))
+	rootCmd.PersistentFlags().Bool("tls-session-tickets", true, "let TLS clients resume sessions with session tickets")
+	bindFlag("tls-session-tickets", rootCmd.PersistentFlags().Lookup("tls-session-tickets"))
+	rootCmd.PersistentFlags().Bool("h2c", false, "accept HTTP/2 without TLS (loopback listen addresses only)")
+	bindFlag("h2c", rootCmd.PersistentFlags().Lookup("h2c"))
+	rootCmd.PersistentFlags().StringSlice("trusted-proxies", nil, "addresses or CIDRs of proxies trusted to forward client addresses")
+	bindFlag("trusted-proxies", rootCmd.PersistentFlags().Lookup("trusted-proxies"))
+	rootCmd.PersistentFlags().Bool("proxy-protocol", false, "accept PROXY protocol headers from trusted proxies")
+	bindFlag("proxy-protocol", rootCmd.PersistentFlags().Lookup("proxy-protocol"))
+	rootCmd.PersistentFlags().StringP("scheduler", "", "round-robin", "device queuing between clients: round-robin or weighted")
+	bindFlag("scheduler", rootCmd.PersistentFlags().Lookup("scheduler"))
+	rootCmd.PersistentFlags().Int("max-queue-depth", 0, "requests allowed to wait for the device before refusing more (default 0, unbounded)")
+	bindFlag("max-queue-depth", rootCmd.PersistentFlags().Lookup("max-queue-depth"))
+	rootCmd.PersistentFlags().Duration("max-queue-wait", 0, "how long a request may wait for the device (default 0, forever)")
+	bindFlag("max-queue-wait", rootCmd.PersistentFlags().Lookup("max-queue-wait"))
+	rootCmd.PersistentFlags().Duration("drain-timeout", 30*time.Second, "how long requests in flight may take to finish when shutting down")
+	bindFlag("drain-timeout", rootCmd.PersistentFlags().Lookup("drain-timeout"))
+	rootCmd.PersistentFlags().Duration("max-request-timeout", 0, "longest a request may take, also capping X-Request-Timeout (default 0, no limit)")
+	bindFlag("max-request-timeout", rootCmd.PersistentFlags().Lookup("max-request-timeout"))
+	rootCmd.PersistentFlags().Bool("allow-unknown-commands", false, "pass frames with unknown commands on to the device")
+	bindFlag("allow-unknown-commands", rootCmd.PersistentFlags().Lookup("allow-unknown-commands"))
+	rootCmd.PersistentFlags().Duration("idempotency-window", 0, "how long to answer retries by X-Request-ID from a response cache (default 0, disabled)")
+	bindFlag("idempotency-window", rootCmd.PersistentFlags().Lookup("idempotency-window"))
+	rootCmd.PersistentFlags().StringP("socket-mode", "", "0660", "file mode of the socket when listening on unix:/path")
+	bindFlag("socket-mode", rootCmd.PersistentFlags().Lookup("socket-mode"))
+	rootCmd.PersistentFlags().StringP("socket-owner", "", "", "owner of the socket when listening on unix:/path, as user, user:group or :group")
+	bindFlag("socket-owner", rootCmd.PersistentFlags().Lookup("socket-owner"))
+	rootCmd.PersistentFlags().StringP("grpc-listen", "", "", "gRPC listen address (default none, disabled)")
+	bindFlag("grpc-listen", rootCmd.PersistentFlags().Lookup("grpc-listen"))
+	rootCmd.PersistentFlags().StringP("grpc-client-ca", "", "", "CA certificates to verify gRPC client certificates with, requiring them")
+	bindFlag("grpc-client-ca", rootCmd.PersistentFlags().Lookup("grpc-client-ca"))
+	rootCmd.PersistentFlags().StringP("audit-log", "", "", "audit log file (default is the regular log)")
+	bindFlag("audit-log", rootCmd.PersistentFlags().Lookup("audit-log"))
+	rootCmd.PersistentFlags().StringP("record", "", "", "record api exchanges to a capture file")
+	bindFlag("record", rootCmd.PersistentFlags().Lookup("record"))
+	rootCmd.PersistentFlags().StringP("otel-endpoint", "", "", "OTLP/HTTP endpoint to export traces to")
+	bindFlag("otel-endpoint", rootCmd.PersistentFlags().Lookup("otel-endpoint"))
+	rootCmd.PersistentFlags().StringP("otel-file", "", "", "file to export traces to, for testing")
+	bindFlag("otel-file", rootCmd.PersistentFlags().Lookup("otel-file"))
 	rootCmd.PersistentFlags().Uint32P("timeout", "t", 0, "(DEPRECATED) USB operation timeout in milliseconds (default 0, never timeout)")
-	viper.BindPFlag("timeout", rootCmd.PersistentFlags().Lookup("timeout"))
+	bindFlag("timeout", rootCmd.PersistentFlags().Lookup("timeout"))
 
 	configCmd := &cobra.Command{
 		Use: "config",
@@ -227,11 +447,66 @@ func main() {
 Most configuration knobs for the connector are not available at the command
 line, and must be supplied via a configurtion file.
 
-listen: localhost:12345
+On SIGHUP, or when the file changes, the configuration is read again. The
+log level, policy, serial, and each listener's certificate, auth and host
+allowlist take effect right away; other changes are logged as needing a
+restart. A configuration that does not validate is ignored.
+
+listen: localhost:12345       # or unix:/run/yubihsm/connector.sock
+socket-mode: "0660"
+socket-owner: yubihsm-connector:yubihsm
 syslog: false
 cert: /path/to/certificate.crt
-key: /path/to/certificate.key
+key: /path/to/certificate.key # encrypted PKCS#8 or not
+pkcs12: /path/to/bundle.p12   # instead of cert and key
+key-passphrase-file: /path/to/passphrase # or key-passphrase-env: VARIABLE
+                                         # or key-passphrase-credential: NAME
+tls-profile: compatible       # modern, compatible or fips-approved
+tls-min-version: "1.2"        # and tls-max-version, 1.0 to 1.3
+tls-cipher-suites: [TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256]
+tls-curves: [X25519, P-256]
+tls-session-tickets: true
 serial: 0123456789
+trusted-proxies: [10.0.0.1, 192.168.0.0/24]
+proxy-protocol: false
+record: /path/to/capture.jsonl
+otel-endpoint: http://localhost:4318
+audit-log: /path/to/audit.log
+scheduler: weighted
+max-queue-depth: 32
+max-queue-wait: 10s
+max-request-timeout: 60s
+allow-unknown-commands: false
+idempotency-window: 5m
+drain-timeout: 30s
+grpc-listen: localhost:12346
+grpc-client-ca: /path/to/client-ca.crt
+listeners:                    # instead of listen, cert, key and friends
+  - listen: localhost:12345
+    routes: [api, ws, status]
+  - listen: 10.0.0.1:8443
+    cert: /path/to/certificate.crt
+    key: /path/to/certificate.key
+    client-ca: /path/to/client-ca.crt
+    auth: [client-cert]         # api-key, client-cert or peer
+    routes: [status, metrics]   # api, ws, status or metrics
+    host-allowlist: [hsm.example.com]
+  - listen: unix:/run/yubihsm/connector.sock
+    socket-mode: "0660"
+    auth: [peer]
+policy:
+  - name: batch
+    subjects: ["ip:10.1.0.0/16", "cert:CN=batch.example.com"]
+    rate: 10          # requests per second
+    burst: 20
+    max-in-flight: 2
+  - name: interactive
+    subjects: ["ip:10.2.0.0/16"]
+    priority: 1       # served before lower priority classes
+    weight: 4         # requests per turn with the weighted scheduler
+  - name: default
+    subjects: ["*"]
+    rate: 50
 `,
 	}
 	configCheckCmd := &cobra.Command{
@@ -282,6 +557,125 @@ serial: 0123456789
 		},
 	}
 
+	replayCmd := &cobra.Command{
+		Use: "replay <capture>",
+		Long: `Serve a recorded capture file as if it were a device
+
+Requests are matched against the capture in the recorded order and
+answered with the recorded response. Mismatching requests are logged and
+answered with an error.`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return rootCmd.PreRunE(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			exchanges, err := loadCapture(args[0])
+			if err != nil {
+				return err
+			}
+			commandOnly, _ := cmd.Flags().GetBool("match-command")
+			r := &replayer{exchanges: exchanges, commandOnly: commandOnly}
+			deviceProxy = r.proxy
+			deviceCheck = r.check
+			deviceList = r.list
+
+			log.WithFields(log.Fields{
+				"capture":   args[0],
+				"exchanges": len(exchanges),
+			}).Info("replaying capture")
+
+			return s.Run()
+		},
+	}
+	replayCmd.Flags().Bool("match-command", false, "only match the command byte of requests")
+
+	decodeCmd := &cobra.Command{
+		Use: "decode [hex]...",
+		Long: `Pretty print YubiHSM 2 wire frames
+
+Frames are taken as hex arguments, or read from a file. Files may be
+capture files, debug logs containing "usb endpoint write" and "usb
+endpoint read" lines, or hex with one frame per line. With neither
+arguments nor a file, frames are read from standard input.`,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, _ := cmd.Flags().GetString("file")
+			if file == "" && len(args) == 0 {
+				file = "-"
+			}
+
+			for _, arg := range args {
+				buf, err := decodeHex(arg)
+				if err != nil {
+					return err
+				}
+				decodeFrame(os.Stdout, buf)
+			}
+
+			if file == "-" {
+				return decodeStream(os.Stdout, os.Stdin)
+			} else if file != "" {
+				f, err := os.Open(file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				return decodeStream(os.Stdout, f)
+			}
+			return nil
+		},
+	}
+	decodeCmd.Flags().StringP("file", "f", "", "capture, debug log or hex file to decode (- for stdin)")
+
+	sendCmd := &cobra.Command{
+		Use: "send",
+		Long: `Send a raw frame to a device or a remote connector
+
+Without --url the frame is sent to a local device, selected by --serial.
+With --interactive, frames are read from standard input; type help for
+the available commands.`,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return rootCmd.PreRunE(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req, _ := cmd.Flags().GetString("hex")
+			url, _ := cmd.Flags().GetString("url")
+			interactive, _ := cmd.Flags().GetBool("interactive")
+			if req == "" && !interactive {
+				return fmt.Errorf("one of --hex or --interactive must be specified")
+			}
+
+			var send sender
+			if url != "" {
+				send = httpSender(url)
+			} else {
+				serial, _ := ensureSerial(viper.GetString("serial"))
+				send = usbSender(serial)
+				defer usbclose("send")
+			}
+
+			if req != "" {
+				buf, err := decodeHex(req)
+				if err != nil {
+					return err
+				}
+				if err = sendFrame(os.Stdout, send, buf); err != nil {
+					return err
+				}
+			}
+			if interactive {
+				return sendREPL(os.Stdout, os.Stdin, send)
+			}
+			return nil
+		},
+	}
+	sendCmd.Flags().String("hex", "", "frame to send, hex encoded")
+	sendCmd.Flags().String("url", "", "remote connector url, instead of a local device")
+	sendCmd.Flags().BoolP("interactive", "i", false, "read frames from standard input")
+
 	installCmd := &cobra.Command{
 		Use:  "install",
 		Long: "Install YubiHSM Connector service",
@@ -325,6 +719,9 @@ serial: 0123456789
 	configCmd.AddCommand(configCheckCmd, configGenCmd)
 	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(replayCmd)
+	rootCmd.AddCommand(decodeCmd)
+	rootCmd.AddCommand(sendCmd)
 	rootCmd.AddCommand(installCmd)
 	rootCmd.AddCommand(uninstallCmd)
 	rootCmd.AddCommand(startCmd)
@@ -341,6 +738,52 @@ serial: 0123456789
 	}
 }
 
+// validateConfig checks the settings in v, at startup and when reloading.
+func validateConfig(v *viper.Viper) (err error) {
+	cert := certSourceFrom(v)
+	if err = cert.validate(); err != nil {
+		return err
+	}
+
+	if _, err = ensureSerial(v.GetString("serial")); err != nil {
+		return err
+	}
+
+	if _, err = loadListeners(v); err != nil {
+		return err
+	}
+
+	if grpcAddr := v.GetString("grpc-listen"); grpcAddr != "" {
+		if !cert.configured() && !isLoopback(grpcAddr) {
+			return fmt.Errorf("grpc without TLS is only allowed on a loopback listen address")
+		}
+		if v.GetString("grpc-client-ca") != "" && !cert.configured() {
+			return fmt.Errorf("grpc-client-ca requires cert and key")
+		}
+	}
+
+	if v.GetDuration("idempotency-window") < 0 {
+		return fmt.Errorf("idempotency-window must not be negative")
+	}
+	if v.GetDuration("drain-timeout") < 0 {
+		return fmt.Errorf("drain-timeout must not be negative")
+	}
+
+	if _, err = parseTrustedProxies(v.GetStringSlice("trusted-proxies")); err != nil {
+		return err
+	}
+	if _, err = loadTLSSettings(v); err != nil {
+		return err
+	}
+	if _, err = loadPolicy(v); err != nil {
+		return err
+	}
+	if _, err = loadScheduler(v); err != nil {
+		return err
+	}
+	return nil
+}
+
 // XXX(thorduri): Barf.
 var errInvalidSerial = fmt.Errorf("invalid device serial")
 
@@ -363,6 +806,29 @@ func ensureSerial(s string) (string, error) {
 	return s, nil
 }
 
+// isLoopback reports whether a listen address only binds loopback
+// interfaces, or a Unix socket. Names are resolved, and must resolve to
+// loopback only.
+func isLoopback(addr string) bool {
+	if isUnixAddr(addr) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
+
 func timeoutToMs(t uint32) time.Duration {
 	return time.Duration(t) * time.Millisecond
 }
@@ -15,9 +15,23 @@
 package main
 
 import (
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/spf13/viper"
 )
 
+// testConfig returns a configuration read from YAML.
+func testConfig(t *testing.T, config string) *viper.Viper {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
 type ensureSerialTest struct {
 	iserial string
 	oserial string
@@ -67,3 +81,31 @@ func TestEnsureSerial(t *testing.T) {
 		}
 	}
 }
+
+type requestTimeoutTest struct {
+	header  string
+	max     time.Duration
+	timeout time.Duration
+	err     error
+}
+
+var requestTimeoutTests = []requestTimeoutTest{
+	{"", 0, 0, nil},
+	{"", time.Minute, time.Minute, nil},
+	{"1500", 0, 1500 * time.Millisecond, nil},
+	{"2s", 0, 2 * time.Second, nil},
+	{"2m", time.Minute, time.Minute, nil},
+	{"-1s", 0, 0, errRequestTimeout},
+	{"soon", 0, 0, errRequestTimeout},
+}
+
+func TestRequestTimeout(t *testing.T) {
+	for i, test := range requestTimeoutTests {
+		timeout, err := requestTimeout(test.header, test.max)
+		if err != test.err {
+			t.Fatalf("requestTimeoutTest %d: got %v: expected %v", i, err, test.err)
+		} else if timeout != test.timeout {
+			t.Fatalf("requestTimeoutTest %d: got %v: expected %v", i, timeout, test.timeout)
+		}
+	}
+}
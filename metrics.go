@@ -0,0 +1,133 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A minimal registry producing the Prometheus text exposition format.
+// Metrics either keep their own values, or are computed when scraped.
+
+type collector interface {
+	collect(w io.Writer)
+}
+
+var registry []collector
+
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mtx    sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(kind string, name string, help string, labels ...string) *metricVec {
+	m := &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: map[string]float64{},
+	}
+	registry = append(registry, m)
+	return m
+}
+
+func newCounter(name string, help string, labels ...string) *metricVec {
+	return newMetricVec("counter", name, help, labels...)
+}
+
+func newGauge(name string, help string, labels ...string) *metricVec {
+	return newMetricVec("gauge", name, help, labels...)
+}
+
+// labelString renders label pairs, escaped as the format requires.
+func labelString(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metricVec) add(v float64, labels ...string) {
+	key := labelString(m.labels, labels)
+
+	m.mtx.Lock()
+	m.values[key] += v
+	m.mtx.Unlock()
+}
+
+func (m *metricVec) inc(labels ...string) {
+	m.add(1, labels...)
+}
+
+func (m *metricVec) set(v float64, labels ...string) {
+	key := labelString(m.labels, labels)
+
+	m.mtx.Lock()
+	m.values[key] = v
+	m.mtx.Unlock()
+}
+
+func (m *metricVec) collect(w io.Writer) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, k, strconv.FormatFloat(m.values[k], 'g', -1, 64))
+	}
+}
+
+// collectorFunc is a metric computed at scrape time.
+type collectorFunc func(w io.Writer)
+
+func (f collectorFunc) collect(w io.Writer) {
+	f(w)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, c := range registry {
+		c.collect(w)
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+// policyEntry applies limits to the clients matching any of its subjects.
+// Subjects are one of
+//
+//	ip:<address or CIDR>       the client address, see clientIP
+//	cert:<subject DN>          the subject of a verified client certificate
+//	api-key-sha256:<hex>       the SHA-256 of a bearer token
+//	uid:<user name or ID>      the user of a process connecting over a Unix socket
+//	gid:<group name or ID>     the group of such a process
+//	*                          any client
+//
+// Every client gets its own bucket; an entry matching a whole network
+// limits each address in it separately.
+type policyEntry struct {
+	Name        string   `mapstructure:"name"`
+	Subjects    []string `mapstructure:"subjects"`
+	Rate        float64  `mapstructure:"rate"`
+	Burst       int      `mapstructure:"burst"`
+	MaxInFlight int      `mapstructure:"max-in-flight"`
+	// Priority class and weight when queuing for the device, see scheduler.
+	Priority int `mapstructure:"priority"`
+	Weight   int `mapstructure:"weight"`
+
+	nets  []*net.IPNet
+	certs []string
+	keys  [][]byte
+	uids  []uint32
+	gids  []uint32
+	any   bool
+}
+
+func (e *policyEntry) compile() error {
+	for _, s := range e.Subjects {
+		kind, value, _ := strings.Cut(s, ":")
+		switch kind {
+		case "*":
+			e.any = true
+		case "ip":
+			nets, err := parseTrustedProxies([]string{value})
+			if err != nil {
+				return fmt.Errorf("policy %q: %w", e.Name, err)
+			}
+			e.nets = append(e.nets, nets...)
+		case "cert":
+			e.certs = append(e.certs, value)
+		case "api-key-sha256":
+			key, err := hex.DecodeString(value)
+			if err != nil || len(key) != sha256.Size {
+				return fmt.Errorf("policy %q: invalid api key hash", e.Name)
+			}
+			e.keys = append(e.keys, key)
+		case "uid", "gid":
+			id, err := lookupID(kind, value)
+			if err != nil {
+				return fmt.Errorf("policy %q: %w", e.Name, err)
+			}
+			if kind == "uid" {
+				e.uids = append(e.uids, uint32(id))
+			} else {
+				e.gids = append(e.gids, uint32(id))
+			}
+		default:
+			return fmt.Errorf("policy %q: unknown subject %q", e.Name, s)
+		}
+	}
+	if e.Rate < 0 || e.Burst < 0 || e.MaxInFlight < 0 || e.Weight < 0 {
+		return fmt.Errorf("policy %q: limits must not be negative", e.Name)
+	}
+	return nil
+}
+
+// identity is who a request is attributed to for the purpose of policy.
+type identity struct {
+	// id keys the client's limiters, and is logged and audited.
+	id    string
+	entry *policyEntry
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, id identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// identityFrom returns the client a request was attributed to. Requests
+// not coming in over HTTP, such as from the send command, are local.
+func identityFrom(ctx context.Context) identity {
+	if id, ok := ctx.Value(identityKey{}).(identity); ok {
+		return id
+	}
+	return identity{id: "local"}
+}
+
+type policy struct {
+	entries []*policyEntry
+	limits  *clientLimits
+}
+
+func loadPolicy(v *viper.Viper) (*policy, error) {
+	var entries []*policyEntry
+	if err := v.UnmarshalKey("policy", &entries); err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if e.Name == "" {
+			e.Name = fmt.Sprintf("#%d", i)
+		}
+		if err := e.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return &policy{entries: entries, limits: newClientLimits()}, nil
+}
+
+// activePolicy is the policy enforced by middlewareWrapper, which a
+// reload may swap.
+var activePolicy atomic.Pointer[policy]
+
+func init() {
+	activePolicy.Store(&policy{limits: newClientLimits()})
+}
+
+func bearerToken(r *http.Request) string {
+	return parseBearer(r.Header.Get("Authorization"))
+}
+
+func parseBearer(auth string) string {
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// identify attributes r to a client, preferring the strongest credential
+// presented: an API key, then a client certificate, then the user of a
+// process on the other end of a Unix socket, then the address. The entry
+// is the first one in the policy matching that credential.
+func (p *policy) identify(r *http.Request, ip string) identity {
+	var chains [][]*x509.Certificate
+	if r.TLS != nil {
+		chains = r.TLS.VerifiedChains
+	}
+	cred, _ := unixPeer(r.Context())
+	return p.identifyCredentials(bearerToken(r), chains, cred, ip)
+}
+
+// identifyCredentials is identify for credentials presented other than
+// over HTTP.
+func (p *policy) identifyCredentials(token string, chains [][]*x509.Certificate, cred *peerCred, ip string) identity {
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		for _, e := range p.entries {
+			for _, key := range e.keys {
+				if subtle.ConstantTimeCompare(sum[:], key) == 1 {
+					return identity{id: "api-key:" + hex.EncodeToString(sum[:4]), entry: e}
+				}
+			}
+		}
+	}
+
+	if len(chains) > 0 {
+		subject := chains[0][0].Subject.String()
+		for _, e := range p.entries {
+			for _, cert := range e.certs {
+				if cert == subject {
+					return identity{id: "cert:" + subject, entry: e}
+				}
+			}
+		}
+	}
+
+	if cred != nil {
+		id := identity{id: fmt.Sprintf("uid:%d", cred.uid)}
+		for _, e := range p.entries {
+			if e.any || containsID(e.uids, cred.uid) || containsID(e.gids, cred.gid) {
+				id.entry = e
+				break
+			}
+		}
+		return id
+	}
+
+	id := identity{id: "ip:" + ip}
+	addr := net.ParseIP(ip)
+	for _, e := range p.entries {
+		if e.any || isTrustedProxy(addr, e.nets) {
+			id.entry = e
+			break
+		}
+	}
+	return id
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+// clientLimits keeps a token bucket and an in-flight count per client.
+type clientLimits struct {
+	mtx     sync.Mutex
+	clients map[string]*clientLimit
+	swept   time.Time
+}
+
+type clientLimit struct {
+	limiter  *rate.Limiter
+	inFlight int
+	lastSeen time.Time
+}
+
+func newClientLimits() *clientLimits {
+	return &clientLimits{clients: map[string]*clientLimit{}, swept: time.Now()}
+}
+
+// Clients idle for this long are forgotten, refilling their buckets.
+const clientLimitIdle = 10 * time.Minute
+
+// admit accounts a request from id. When it is refused, retryAfter
+// is how long the client should back off. Otherwise release must be
+// called once the request is done.
+func (l *clientLimits) admit(id identity) (release func(), retryAfter time.Duration, ok bool) {
+	e := id.entry
+	if e == nil || (e.Rate == 0 && e.MaxInFlight == 0) {
+		return func() {}, 0, true
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	c := l.client(id, now)
+	if e.MaxInFlight > 0 && c.inFlight >= e.MaxInFlight {
+		return nil, time.Second, false
+	}
+	if retryAfter, ok = c.take(now); !ok {
+		return nil, retryAfter, false
+	}
+
+	c.inFlight++
+	return func() {
+		l.mtx.Lock()
+		c.inFlight--
+		l.mtx.Unlock()
+	}, 0, true
+}
+
+// allow accounts a request from id against its rate only, for requests
+// made over a connection that is itself admitted, like a WebSocket.
+func (l *clientLimits) allow(id identity) (retryAfter time.Duration, ok bool) {
+	e := id.entry
+	if e == nil || e.Rate == 0 {
+		return 0, true
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	return l.client(id, now).take(now)
+}
+
+// client returns the limits kept for id, forgetting idle clients on
+// the way. Called with mtx held.
+func (l *clientLimits) client(id identity, now time.Time) *clientLimit {
+	if now.Sub(l.swept) > clientLimitIdle {
+		for k, c := range l.clients {
+			if c.inFlight == 0 && now.Sub(c.lastSeen) > clientLimitIdle {
+				delete(l.clients, k)
+			}
+		}
+		l.swept = now
+	}
+
+	c, found := l.clients[id.id]
+	if !found {
+		e := id.entry
+		limit, burst := rate.Inf, 0
+		if e.Rate > 0 {
+			limit, burst = rate.Limit(e.Rate), e.Burst
+			if burst < 1 {
+				burst = int(math.Max(1, math.Ceil(e.Rate)))
+			}
+		}
+		c = &clientLimit{limiter: rate.NewLimiter(limit, burst)}
+		l.clients[id.id] = c
+	}
+	c.lastSeen = now
+	return c
+}
+
+// take a token from the client's bucket, if one is available now.
+func (c *clientLimit) take(now time.Time) (retryAfter time.Duration, ok bool) {
+	if res := c.limiter.ReserveN(now, 1); !res.OK() {
+		return time.Second, false
+	} else if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return delay, false
+	}
+	return 0, true
+}
@@ -0,0 +1,131 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+const testPolicy = `
+policy:
+  - name: batch
+    subjects: ["ip:10.1.0.0/16", "api-key-sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"]
+    rate: 1
+    burst: 2
+    max-in-flight: 1
+  - name: default
+    subjects: ["*"]
+`
+
+func loadTestPolicy(t *testing.T, config string) (*policy, error) {
+	return loadPolicy(testConfig(t, config))
+}
+
+func TestPolicyIdentify(t *testing.T) {
+	p, err := loadTestPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &http.Request{Header: http.Header{}}
+	if id := p.identify(r, "10.1.2.3"); id.id != "ip:10.1.2.3" || id.entry.Name != "batch" {
+		t.Fatalf("got %q in %q: expected ip:10.1.2.3 in batch", id.id, id.entry.Name)
+	}
+	if id := p.identify(r, "192.0.2.1"); id.entry.Name != "default" {
+		t.Fatalf("got %q: expected default", id.entry.Name)
+	}
+
+	r.Header.Set("Authorization", "Bearer test")
+	if id := p.identify(r, "192.0.2.1"); id.id != "api-key:9f86d081" || id.entry.Name != "batch" {
+		t.Fatalf("got %q in %q: expected api-key:9f86d081 in batch", id.id, id.entry.Name)
+	}
+	r.Header.Set("Authorization", "Bearer wrong")
+	if id := p.identify(r, "192.0.2.1"); id.id != "ip:192.0.2.1" {
+		t.Fatalf("got %q: expected ip:192.0.2.1", id.id)
+	}
+}
+
+func TestPolicyPeerCred(t *testing.T) {
+	p, err := loadTestPolicy(t, `
+policy:
+  - name: signer
+    subjects: ["uid:1000", "gid:2000"]
+  - name: other
+    subjects: ["ip:127.0.0.1"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id := p.identifyCredentials("", nil, &peerCred{uid: 1000, gid: 1}, "@"); id.id != "uid:1000" || id.entry == nil || id.entry.Name != "signer" {
+		t.Fatalf("got %q in %v: expected uid:1000 in signer", id.id, id.entry)
+	}
+	if id := p.identifyCredentials("", nil, &peerCred{uid: 1001, gid: 2000}, "@"); id.entry == nil || id.entry.Name != "signer" {
+		t.Fatalf("got %v: expected signer by group", id.entry)
+	}
+	if id := p.identifyCredentials("", nil, &peerCred{uid: 1001, gid: 1}, "127.0.0.1"); id.entry != nil {
+		t.Fatalf("got %q: address subjects should not match socket peers", id.entry.Name)
+	}
+}
+
+func TestPolicyLimits(t *testing.T) {
+	p, err := loadTestPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &http.Request{Header: http.Header{}}
+	id := p.identify(r, "10.1.2.3")
+
+	release, _, ok := p.limits.admit(id)
+	if !ok {
+		t.Fatalf("first request refused")
+	}
+	if _, _, ok = p.limits.admit(id); ok {
+		t.Fatalf("request over max-in-flight admitted")
+	}
+	release()
+
+	// The second token of the burst, then the bucket is empty.
+	release, _, ok = p.limits.admit(id)
+	if !ok {
+		t.Fatalf("request within burst refused")
+	}
+	release()
+	_, retryAfter, ok := p.limits.admit(id)
+	if ok {
+		t.Fatalf("request over rate admitted")
+	} else if retryAfter <= 0 {
+		t.Fatalf("got retry after %v: expected a positive delay", retryAfter)
+	}
+
+	// Other clients in the same network have buckets of their own.
+	if _, _, ok = p.limits.admit(p.identify(r, "10.1.2.4")); !ok {
+		t.Fatalf("request from another client refused")
+	}
+}
+
+func TestPolicyInvalid(t *testing.T) {
+	for _, config := range []string{
+		"policy: [{subjects: [\"ip:nonsense\"]}]",
+		"policy: [{subjects: [\"host:example.com\"]}]",
+		"policy: [{subjects: [\"uid:no-such-user-here\"]}]",
+		"policy: [{subjects: [\"*\"], rate: -1}]",
+	} {
+		if _, err := loadTestPolicy(t, config); err == nil {
+			t.Fatalf("policy %q was accepted", config)
+		}
+	}
+}
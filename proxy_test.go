@@ -0,0 +1,95 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type clientIPTest struct {
+	remote string
+	xff    string
+	real   string
+	ip     string
+}
+
+var clientIPTests = []clientIPTest{
+	{"192.0.2.1:1234", "", "", "192.0.2.1"},
+	{"[2001:db8::1]:1234", "", "", "2001:db8::1"},
+	// Untrusted peers cannot claim another address.
+	{"192.0.2.1:1234", "198.51.100.7", "198.51.100.8", "192.0.2.1"},
+	{"10.0.0.1:1234", "198.51.100.7", "", "198.51.100.7"},
+	{"10.0.0.1:1234", "", "198.51.100.8", "198.51.100.8"},
+	// Spoofed leftmost entries are skipped in favour of the nearest
+	// address not belonging to a trusted proxy.
+	{"10.0.0.1:1234", "203.0.113.9, 198.51.100.7, 10.0.0.2", "", "198.51.100.7"},
+	{"[fd00::1]:1234", "2001:db8::7", "", "2001:db8::7"},
+	{"10.0.0.1:1234", "garbage", "", "10.0.0.1"},
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "fd00::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range clientIPTests {
+		r := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+		if test.xff != "" {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if test.real != "" {
+			r.Header.Set("X-Real-IP", test.real)
+		}
+		if ip := clientIP(r, trusted); ip != test.ip {
+			t.Fatalf("clientIPTest %d: got %q: expected %q", i, ip, test.ip)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x11\x00\x0c" +
+		"\xc6\x33\x64\x07" + "\x0a\x00\x00\x01" + "\x30\x39" + "\x00\x50"
+	tests := []struct {
+		in   string
+		addr string
+	}{
+		{"PROXY TCP4 198.51.100.7 10.0.0.1 12345 80\r\nGET /", "198.51.100.7:12345"},
+		{"PROXY TCP6 2001:db8::7 fd00::1 12345 80\r\nGET /", "[2001:db8::7]:12345"},
+		{v2 + "GET /", "198.51.100.7:12345"},
+		{"PROXY UNKNOWN\r\nGET /", ""},
+		{"GET /", ""},
+	}
+	for i, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.in))
+		addr, err := readProxyHeader(r)
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		if (addr == nil && test.addr != "") || (addr != nil && addr.String() != test.addr) {
+			t.Fatalf("test %d: got %v: expected %q", i, addr, test.addr)
+		}
+		if rest, _ := r.ReadString(0); rest != "GET /" {
+			t.Fatalf("test %d: header not consumed, got %q", i, rest)
+		}
+	}
+
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 nonsense\r\n"))
+	if _, err := readProxyHeader(r); err != errProxyHeader {
+		t.Fatalf("got %v: expected %v", err, errProxyHeader)
+	}
+}
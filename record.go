@@ -0,0 +1,200 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The functions apiHandler and statusHandler use to reach the device.
+// Replay mode swaps these out for a replayer serving a capture file.
+var (
+	deviceProxy = usbProxy
+	deviceCheck = usbCheck
+	deviceList  = usbList
+)
+
+// exchange is a single request/response pair as stored in a capture
+// file. Captures are JSON lines, one exchange per line, with the frames
+// hex encoded so they can be read and edited by hand.
+type exchange struct {
+	Time     time.Time `json:"time"`
+	Request  hexFrame  `json:"request"`
+	Response hexFrame  `json:"response"`
+}
+
+type hexFrame []byte
+
+func (f hexFrame) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(f))
+}
+
+func (f *hexFrame) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*f = buf
+	return nil
+}
+
+type recorder struct {
+	mtx sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// rec is the active recorder, if any.
+var rec *recorder
+
+func newRecorder(path string) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{w: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *recorder) record(req, resp []byte) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.enc.Encode(&exchange{
+		Time:     time.Now().UTC(),
+		Request:  req,
+		Response: resp,
+	})
+}
+
+func (r *recorder) close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.w.Close()
+}
+
+func readCapture(rd io.Reader) (exchanges []exchange, err error) {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e exchange
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("capture line %d: %w", line, err)
+		}
+		exchanges = append(exchanges, e)
+	}
+
+	return exchanges, scanner.Err()
+}
+
+func loadCapture(path string) ([]exchange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readCapture(f)
+}
+
+// replayer plays back a capture as if it were a device. Requests must
+// arrive in the recorded order; a request that does not match the next
+// recorded one is reported and does not advance the replay.
+type replayer struct {
+	mtx       sync.Mutex
+	exchanges []exchange
+	next      int
+
+	// commandOnly relaxes matching to the command byte, for clients
+	// whose payloads are not deterministic (host challenges, etc).
+	commandOnly bool
+
+	mismatches int
+}
+
+var errReplayExhausted = fmt.Errorf("replay capture exhausted")
+
+func (r *replayer) matches(want, got []byte) bool {
+	if r.commandOnly {
+		return len(want) > 0 && len(got) > 0 && want[0] == got[0]
+	}
+	return bytes.Equal(want, got)
+}
+
+func (r *replayer) proxy(ctx context.Context, req []byte, cid string, serial string) ([]byte, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	clog := log.WithFields(log.Fields{
+		"Correlation-ID": cid,
+		"index":          r.next,
+	})
+
+	if r.next >= len(r.exchanges) {
+		r.mismatches++
+		clog.WithField("got", hex.EncodeToString(req)).Error("replay request after end of capture")
+		return nil, errReplayExhausted
+	}
+
+	e := r.exchanges[r.next]
+	if !r.matches(e.Request, req) {
+		r.mismatches++
+		clog.WithFields(log.Fields{
+			"want": hex.EncodeToString(e.Request),
+			"got":  hex.EncodeToString(req),
+		}).Error("replay request mismatch")
+		return nil, fmt.Errorf("replay mismatch at exchange %d", r.next)
+	}
+
+	r.next++
+	clog.Debug("replayed exchange")
+	if r.next == len(r.exchanges) {
+		log.WithField("mismatches", r.mismatches).Info("replay capture fully consumed")
+	}
+
+	return e.Response, nil
+}
+
+func (r *replayer) check(ctx context.Context, cid string, serial string) error {
+	return nil
+}
+
+// list reports no devices, as none are attached when replaying.
+func (r *replayer) list(ctx context.Context, cid string) ([]string, error) {
+	return nil, nil
+}
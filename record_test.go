@@ -0,0 +1,75 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+
+	r, err := newRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := []byte{0x01, 0x00, 0x02, 0xca, 0xfe}
+	echoResp := []byte{0x81, 0x00, 0x02, 0xca, 0xfe}
+	info := []byte{0x06, 0x00, 0x00}
+	infoResp := []byte{0x86, 0x00, 0x01, 0x02}
+	if err = r.record(echo, echoResp); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.record(info, infoResp); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	exchanges, err := loadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exchanges) != 2 {
+		t.Fatalf("got %d exchanges: expected 2", len(exchanges))
+	}
+
+	rp := &replayer{exchanges: exchanges}
+	if _, err = rp.proxy(context.Background(), info, "test", ""); err == nil {
+		t.Fatalf("out of order request was not reported")
+	}
+	resp, err := rp.proxy(context.Background(), echo, "test", "")
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(resp, echoResp) {
+		t.Fatalf("got %x: expected %x", resp, echoResp)
+	}
+	resp, err = rp.proxy(context.Background(), info, "test", "")
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(resp, infoResp) {
+		t.Fatalf("got %x: expected %x", resp, infoResp)
+	}
+	if _, err = rp.proxy(context.Background(), info, "test", ""); err != errReplayExhausted {
+		t.Fatalf("got %v: expected %v", err, errReplayExhausted)
+	}
+	if rp.mismatches != 2 {
+		t.Fatalf("got %d mismatches: expected 2", rp.mismatches)
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// How long the configuration file must be left alone after a change
+// before it is reloaded, as editors tend to write it in several steps.
+const reloadSettle = 500 * time.Millisecond
+
+// Settings a reload applies, or compares listener by listener. Changes to
+// any others take a restart.
+var reloadedSettings = map[string]bool{
+	"config":                    true,
+	"log-level":                 true,
+	"debug":                     true,
+	"policy":                    true,
+	"serial":                    true,
+	"cert":                      true,
+	"key":                       true,
+	"pkcs12":                    true,
+	"key-passphrase-file":       true,
+	"key-passphrase-env":        true,
+	"key-passphrase-credential": true,
+	"enable-host-allowlist":     true,
+	"host-allowlist":            true,
+	"listeners":                 true,
+	"listen":                    true,
+	"h2c":                       true,
+	"proxy-protocol":            true,
+	"socket-mode":               true,
+	"socket-owner":              true,
+}
+
+var configReloads = newCounter("yubihsm_connector_config_reloads_total",
+	"Configuration reloads, by whether they were applied or rejected.", "result")
+
+// flagBinding is a command line flag bound to a configuration key.
+type flagBinding struct {
+	key  string
+	flag *pflag.Flag
+}
+
+var (
+	flagBindings []flagBinding
+	reloadMtx    sync.Mutex
+)
+
+// bindFlag binds flag to key in the configuration, both as read at
+// startup and as reloaded.
+func bindFlag(key string, flag *pflag.Flag) {
+	flagBindings = append(flagBindings, flagBinding{key: key, flag: flag})
+	viper.BindPFlag(key, flag)
+}
+
+// readConfig reads the configuration file in use again, along with the
+// flags and environment, leaving the configuration read at startup be.
+func readConfig() (*viper.Viper, error) {
+	v := viper.New()
+	for _, b := range flagBindings {
+		v.BindPFlag(b.key, b.flag)
+	}
+	v.SetEnvPrefix("YUBIHSM_CONNECTOR")
+	v.AutomaticEnv()
+
+	if path := viper.ConfigFileUsed(); path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// deviceSerial is the serial of the device to use, empty for any, which
+// a reload may change.
+var deviceSerial atomic.Value
+
+func currentSerial() string {
+	serial, _ := deviceSerial.Load().(string)
+	return serial
+}
+
+// configuredLevel returns the log level set in v, if any.
+func configuredLevel(v *viper.Viper) (log.Level, bool) {
+	if level, err := log.ParseLevel(v.GetString("log-level")); err == nil {
+		return level, true
+	}
+	if v.GetBool("debug") {
+		return log.DebugLevel, true
+	}
+	return 0, false
+}
+
+// listenerRestart returns the settings of a listener, as it was and is to
+// be, that differ but take a restart.
+func listenerRestart(was *listenerConfig, is *listenerConfig) (settings []string) {
+	routes := func(l *listenerConfig) string {
+		r := append([]string(nil), l.Routes...)
+		sort.Strings(r)
+		return strings.Join(r, ",")
+	}
+	for _, c := range []struct {
+		setting string
+		changed bool
+	}{
+		{"cert", was.tls() != is.tls()},
+		{"client-ca", was.ClientCA != is.ClientCA},
+		{"routes", routes(was) != routes(is)},
+		{"h2c", was.H2C != is.H2C},
+		{"proxy-protocol", was.ProxyProtocol != is.ProxyProtocol},
+		{"socket-mode", was.SocketMode != is.SocketMode},
+		{"socket-owner", was.SocketOwner != is.SocketOwner},
+	} {
+		if c.changed {
+			settings = append(settings, c.setting)
+		}
+	}
+	return settings
+}
+
+// changedSettings returns the settings other than reloadedSettings that
+// differ between was and is.
+func changedSettings(was *viper.Viper, is *viper.Viper) (settings []string) {
+	keys := map[string]bool{}
+	for _, k := range append(was.AllKeys(), is.AllKeys()...) {
+		keys[k] = true
+	}
+	for k := range keys {
+		top, _, _ := strings.Cut(k, ".")
+		if reloadedSettings[top] {
+			continue
+		}
+		if !reflect.DeepEqual(was.Get(k), is.Get(k)) {
+			settings = append(settings, k)
+		}
+	}
+	sort.Strings(settings)
+	return settings
+}
+
+// reload reads the configuration again and applies what may change while
+// running: the log level, policy and device serial, and for each listener
+// its host allowlist, auth and certificate. It returns the settings that
+// changed but take a restart. A configuration that doesn't validate, or
+// whose certificates don't load, is rejected without applying any of it.
+func (p *program) reload() (restart []string, err error) {
+	reloadMtx.Lock()
+	defer reloadMtx.Unlock()
+
+	v, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err = validateConfig(v); err != nil {
+		return nil, err
+	}
+	listeners, _ := loadListeners(v) // already validated
+	pol, _ := loadPolicy(v)          // already validated
+	serial, _ := ensureSerial(v.GetString("serial"))
+
+	// Load whatever may fail before applying anything.
+	updates := make([]*listenerConfig, len(p.live))
+	certs := make([]*tls.Certificate, len(p.live))
+	found := map[string]bool{}
+	for i, live := range p.live {
+		was := live.config.Load()
+		var is *listenerConfig
+		for _, l := range listeners {
+			if l.Listen == was.Listen {
+				is = l
+			}
+		}
+		if is == nil {
+			restart = append(restart, "listener "+was.Listen+" removed")
+			continue
+		}
+		found[is.Listen] = true
+		for _, setting := range listenerRestart(was, is) {
+			restart = append(restart, "listener "+was.Listen+" "+setting)
+		}
+
+		update := *was
+		update.Auth, update.HostAllowlist = is.Auth, is.HostAllowlist
+		if was.tls() && is.tls() {
+			pair, err := loadCertificate(is.certSource)
+			if err != nil {
+				return nil, fmt.Errorf("listener %s: %w", is.Listen, err)
+			}
+			update.certSource = is.certSource
+			certs[i] = pair
+		}
+		updates[i] = &update
+	}
+	for _, l := range listeners {
+		if !found[l.Listen] {
+			restart = append(restart, "listener "+l.Listen+" added")
+		}
+	}
+
+	var grpcCert *tls.Certificate
+	grpcSource := certSourceFrom(v)
+	if p.grpcSrv != nil {
+		if (p.grpcCert != nil) != grpcSource.configured() {
+			restart = append(restart, "grpc cert")
+		} else if p.grpcCert != nil {
+			pair, err := loadCertificate(grpcSource)
+			if err != nil {
+				return nil, fmt.Errorf("grpc: %w", err)
+			}
+			grpcCert = pair
+		}
+	}
+	restart = append(restart, changedSettings(viper.GetViper(), v)...)
+
+	level, ok := configuredLevel(v)
+	if !ok {
+		level = log.InfoLevel
+	}
+	log.SetLevel(level)
+	activePolicy.Store(pol)
+	for i, live := range p.live {
+		if certs[i] != nil {
+			live.cert.set(updates[i].certSource, certs[i])
+		}
+		if updates[i] != nil {
+			live.config.Store(updates[i])
+		}
+	}
+	if grpcCert != nil {
+		p.grpcCert.set(grpcSource, grpcCert)
+	}
+	// The device is reopened by the next request to reach it.
+	deviceSerial.Store(serial)
+
+	return restart, nil
+}
+
+// reloadAndReport reloads the configuration, and logs and audits the
+// outcome.
+func (p *program) reloadAndReport(trigger string) {
+	restart, err := p.reload()
+	fields := log.Fields{
+		"config":  viper.ConfigFileUsed(),
+		"trigger": trigger,
+	}
+	if err != nil {
+		configReloads.inc("rejected")
+		log.WithFields(fields).WithError(err).Error("configuration rejected, carrying on with the current one")
+		fields["error"] = err.Error()
+		audit("config-rejected", fields)
+		return
+	}
+
+	configReloads.inc("applied")
+	clog := log.WithFields(fields)
+	if len(restart) > 0 {
+		clog.WithField("restart-required", restart).Warn("configuration reloaded, some changes take a restart")
+		fields["restart-required"] = restart
+	} else {
+		clog.Info("configuration reloaded")
+	}
+	audit("config-reloaded", fields)
+}
+
+// handleReloads reloads the configuration on SIGHUP, and whenever the
+// configuration file changes.
+func (p *program) handleReloads() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			p.reloadAndReport("signal")
+		}
+	}()
+
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		// Watch the directory, to follow the file being replaced rather
+		// than written to.
+		err = watcher.Add(filepath.Dir(path))
+	}
+	if err != nil {
+		log.WithError(err).Warn("not watching the configuration file for changes")
+		return
+	}
+
+	go func() {
+		path := filepath.Clean(path)
+		var settle <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == path && event.Op != fsnotify.Chmod {
+					settle = time.After(reloadSettle)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.WithError(err).Warn("error watching the configuration file")
+			case <-settle:
+				settle = nil
+				if _, err := os.Stat(path); err == nil {
+					p.reloadAndReport("file")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,146 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const reloadTestConfig = `
+serial: "12345"
+scheduler: round-robin
+listeners:
+  - listen: "localhost:1"
+    host-allowlist: [a.example.com]
+policy:
+  - name: everyone
+    subjects: ["*"]
+`
+
+// startTestConfig starts a program on config, as written to a file, as
+// far as reloading goes.
+func startTestConfig(t *testing.T, config string) (*program, string) {
+	path := filepath.Join(t.TempDir(), "connector.yaml")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(viper.Reset)
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { deviceSerial.Store("") })
+	listeners, err := loadListeners(viper.GetViper())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &program{}
+	for _, l := range listeners {
+		_, live, err := l.server()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.live = append(p.live, live)
+	}
+	return p, path
+}
+
+func TestReload(t *testing.T) {
+	p, path := startTestConfig(t, reloadTestConfig)
+	defer activePolicy.Store(activePolicy.Load())
+
+	for _, test := range []struct {
+		config  string
+		restart []string
+	}{
+		{`
+serial: "54321"
+scheduler: weighted
+listeners:
+  - listen: "localhost:1"
+    host-allowlist: [b.example.com]
+    auth: [api-key]
+    h2c: true
+  - listen: "localhost:2"
+policy:
+  - name: nobody
+    subjects: ["ip:10.0.0.0/8"]
+`, []string{"listener localhost:1 h2c", "listener localhost:2 added", "scheduler"}},
+		{reloadTestConfig, nil},
+	} {
+		if err := os.WriteFile(path, []byte(test.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		restart, err := p.reload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(restart, test.restart) {
+			t.Fatalf("got restart %q, wanted %q", restart, test.restart)
+		}
+
+		v, _ := readConfig()
+		listeners, _ := loadListeners(v)
+		l := p.live[0].config.Load()
+		if !reflect.DeepEqual(l.HostAllowlist, listeners[0].HostAllowlist) ||
+			!reflect.DeepEqual(l.Auth, listeners[0].Auth) {
+			t.Fatalf("listener not updated: %+v", l)
+		}
+		if l.H2C {
+			t.Fatal("h2c changed without a restart")
+		}
+		serial, _ := ensureSerial(v.GetString("serial"))
+		if currentSerial() != serial {
+			t.Fatalf("serial %q, wanted %q", currentSerial(), serial)
+		}
+		pol, _ := loadPolicy(v)
+		if activePolicy.Load().entries[0].Name != pol.entries[0].Name {
+			t.Fatalf("policy not updated")
+		}
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	p, path := startTestConfig(t, reloadTestConfig)
+	defer activePolicy.Store(activePolicy.Load())
+	if _, err := p.reload(); err != nil {
+		t.Fatal(err)
+	}
+	pol, l := activePolicy.Load(), p.live[0].config.Load()
+
+	for _, config := range []string{
+		"listeners: [{listen: \"localhost:1\", routes: [nonsense]}]",
+		"serial: \"12345678901\"",
+		"policy: [{name: broken, subjects: [\"ip:nonsense\"]}]",
+		"listeners: [{listen: \"localhost:1\", host-allowlist: [b.example.com]}]\nscheduler: random",
+		"{",
+	} {
+		if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.reload(); err == nil {
+			t.Fatalf("config %q was accepted", config)
+		}
+		if activePolicy.Load() != pol || p.live[0].config.Load() != l || currentSerial() != "0000012345" {
+			t.Fatalf("config %q was applied in part", config)
+		}
+	}
+}
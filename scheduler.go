@@ -0,0 +1,491 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// scheduler hands out exclusive access to the device. Waiting requests
+// are queued per client, and clients take turns: higher priority classes
+// are always served first, and within a class clients are served round
+// robin. In weighted mode a client may be served up to its weight in
+// requests per turn.
+//
+// The queue may be bounded in depth and in the time spent waiting, so
+// that requests are shed rather than piling up behind a stuck device.
+type scheduler struct {
+	mtx      sync.Mutex
+	weighted bool
+	maxDepth int
+	maxWait  time.Duration
+	busy     bool
+	holder   string
+	since    time.Time
+	depth    int
+	// Set once the connector is shutting down, see refuse.
+	closed  bool
+	clients map[string]*clientQueue
+	swept   time.Time
+	// Clients with waiting requests, in turn order, per priority class.
+	rings map[int][]*clientQueue
+	// Done once the holder is to give up the device, see abort.
+	aborted context.Context
+	cutOff  context.CancelFunc
+}
+
+type clientQueue struct {
+	client   string
+	priority int
+	weight   int
+	waiters  []*waiter
+	served   int
+	lastSeen time.Time
+
+	waitTotal time.Duration
+	waitCount uint64
+}
+
+type waiter struct {
+	cid      string
+	ready    chan struct{}
+	enqueued time.Time
+	granted  bool
+	// Why the waiter was turned away instead, see refuse.
+	err error
+}
+
+// Errors for requests shed by the scheduler.
+var (
+	errQueueFull    = fmt.Errorf("device queue full")
+	errQueueTimeout = fmt.Errorf("timed out waiting for device")
+	errDraining     = fmt.Errorf("connector shutting down")
+)
+
+const (
+	// Clients without waiting requests are forgotten once idle this long.
+	clientQueueIdle = 10 * time.Minute
+	// Clients reported on by name in status and metrics, the ones with
+	// the most waiting and requests first. The rest are summed up as
+	// "other".
+	queueStatClients = 20
+	// How long a request cut off on shutdown has to let go of the device.
+	abortGrace = 2 * time.Second
+)
+
+var requestsShed = newCounter("yubihsm_connector_requests_shed_total",
+	"Requests refused device access by the scheduler.", "reason")
+
+func newScheduler(weighted bool) *scheduler {
+	s := &scheduler{
+		weighted: weighted,
+		clients:  map[string]*clientQueue{},
+		rings:    map[int][]*clientQueue{},
+	}
+	s.aborted, s.cutOff = context.WithCancel(context.Background())
+	return s
+}
+
+// deviceScheduler guards all access to the device.
+var deviceScheduler = newScheduler(false)
+
+// loadScheduler returns a scheduler with the scheduling mode and queue
+// bounds configured in v.
+func loadScheduler(v *viper.Viper) (s *scheduler, err error) {
+	maxDepth, maxWait := v.GetInt("max-queue-depth"), v.GetDuration("max-queue-wait")
+	switch mode := v.GetString("scheduler"); mode {
+	case "", "round-robin":
+		s = newScheduler(false)
+	case "weighted":
+		s = newScheduler(true)
+	default:
+		return nil, fmt.Errorf("unknown scheduler %q", mode)
+	}
+	if maxDepth < 0 || maxWait < 0 {
+		return nil, fmt.Errorf("queue bounds must not be negative")
+	}
+	s.maxDepth, s.maxWait = maxDepth, maxWait
+	return s, nil
+}
+
+// queue returns the queue of id, forgetting idle clients on the way.
+// Called with mtx held.
+func (s *scheduler) queue(id identity) *clientQueue {
+	now := time.Now()
+	if now.Sub(s.swept) > clientQueueIdle {
+		for k, q := range s.clients {
+			if len(q.waiters) == 0 && now.Sub(q.lastSeen) > clientQueueIdle {
+				delete(s.clients, k)
+			}
+		}
+		s.swept = now
+	}
+
+	q, ok := s.clients[id.id]
+	if !ok {
+		q = &clientQueue{client: id.id}
+		s.clients[id.id] = q
+	}
+	q.lastSeen = now
+	// Follow policy changes for clients that are not currently queued.
+	if len(q.waiters) == 0 {
+		q.priority, q.weight = 0, 1
+		if id.entry != nil {
+			q.priority = id.entry.Priority
+			if id.entry.Weight > 1 {
+				q.weight = id.entry.Weight
+			}
+		}
+	}
+	return q
+}
+
+// acquire waits for the device on behalf of the client in ctx, and
+// request cid. The returned function must be called to hand the device
+// to the next client in line.
+func (s *scheduler) acquire(ctx context.Context, cid string) (release func(), err error) {
+	if h, ok := ctx.Value(holdKey{}).(*deviceHold); ok && h.s == s && h.retain() {
+		return h.done, nil
+	}
+	return s.take(ctx, cid, false)
+}
+
+// take is acquire, other than for holds. Only with draining is the device
+// handed out once the scheduler has been closed.
+func (s *scheduler) take(ctx context.Context, cid string, draining bool) (release func(), err error) {
+	id := identityFrom(ctx)
+
+	s.mtx.Lock()
+	if s.closed && !draining {
+		s.mtx.Unlock()
+		requestsShed.inc("draining")
+		return nil, errDraining
+	}
+	q := s.queue(id)
+	if !s.busy && s.depth == 0 {
+		s.busy = true
+		s.holder, s.since = cid, time.Now()
+		q.waitCount++
+		s.mtx.Unlock()
+		return s.release, nil
+	}
+	if s.maxDepth > 0 && s.depth >= s.maxDepth {
+		s.mtx.Unlock()
+		requestsShed.inc("queue-full")
+		return nil, errQueueFull
+	}
+
+	w := &waiter{cid: cid, ready: make(chan struct{}), enqueued: time.Now()}
+	if len(q.waiters) == 0 {
+		s.rings[q.priority] = append(s.rings[q.priority], q)
+	}
+	q.waiters = append(q.waiters, w)
+	s.depth++
+	s.mtx.Unlock()
+
+	var timeout <-chan time.Time
+	if s.maxWait > 0 {
+		timer := time.NewTimer(s.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-w.ready:
+		if w.err != nil {
+			return nil, w.err
+		}
+		return s.release, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		requestsShed.inc("timeout")
+		err = errQueueTimeout
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if w.granted {
+		// Handed the device as we gave up; pass it on.
+		s.next()
+		return nil, err
+	}
+	if w.err != nil {
+		// Turned away as we gave up, and already out of the queue.
+		return nil, w.err
+	}
+	for i, x := range q.waiters {
+		if x == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			break
+		}
+	}
+	s.depth--
+	if len(q.waiters) == 0 {
+		s.dequeue(q)
+	}
+	return nil, err
+}
+
+// refuse turns away the requests waiting for the device, and any asking
+// for it from now on, leaving the one holding it be.
+func (s *scheduler) refuse() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.closed = true
+	for priority, ring := range s.rings {
+		for _, q := range ring {
+			for _, w := range q.waiters {
+				w.err = errDraining
+				close(w.ready)
+				requestsShed.inc("draining")
+			}
+			q.waiters = nil
+			q.served = 0
+		}
+		delete(s.rings, priority)
+	}
+	s.depth = 0
+}
+
+// quiesce refuses further requests and waits, until ctx is done, for the
+// one holding the device, if any, to finish. It returns with the device
+// held for good.
+func (s *scheduler) quiesce(ctx context.Context) error {
+	s.refuse()
+	_, err := s.take(ctx, "drain", true)
+	return err
+}
+
+// shutdown quiesces the scheduler, waiting until ctx is done for the
+// request holding the device to finish. A request still holding it then
+// is aborted, and given grace to let go of the device. Unless an error is
+// returned, the device is held for good and may be closed.
+func (s *scheduler) shutdown(ctx context.Context, grace time.Duration) error {
+	if err := s.quiesce(ctx); err == nil {
+		return nil
+	}
+	s.abort()
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	return s.quiesce(ctx)
+}
+
+// abort cuts off the request holding the device, and any to hold it
+// after, by cancelling their abortable contexts. Used on shutdown, once
+// the holder has had its time to finish.
+func (s *scheduler) abort() {
+	s.cutOff()
+}
+
+// abortable returns a context for the holder's I/O on the device, done
+// when ctx is or once abort has been called. stop must be called once
+// the I/O is over.
+func (s *scheduler) abortable(ctx context.Context) (_ context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	unhook := context.AfterFunc(s.aborted, cancel)
+	return ctx, func() {
+		unhook()
+		cancel()
+	}
+}
+
+// deviceHold keeps the device across a series of exchanges, see hold.
+type deviceHold struct {
+	s       *scheduler
+	mtx     sync.Mutex
+	refs    int
+	release func()
+}
+
+type holdKey struct{}
+
+// hold acquires the device for a series of exchanges. Acquiring it
+// again with the returned context succeeds at once. The device is handed
+// on once done has been called, and so has every release from within.
+func (s *scheduler) hold(ctx context.Context, cid string) (held context.Context, done func(), err error) {
+	release, err := s.acquire(ctx, cid)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := &deviceHold{s: s, refs: 1, release: release}
+	return context.WithValue(ctx, holdKey{}, h), h.done, nil
+}
+
+func (h *deviceHold) retain() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.refs == 0 {
+		// Already handed on, queue up like everyone else.
+		return false
+	}
+	h.refs++
+	return true
+}
+
+func (h *deviceHold) done() {
+	h.mtx.Lock()
+	h.refs--
+	last := h.refs == 0
+	h.mtx.Unlock()
+
+	if last {
+		h.release()
+	}
+}
+
+func (s *scheduler) release() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.next()
+}
+
+// dequeue takes a client without waiting requests out of turn.
+func (s *scheduler) dequeue(q *clientQueue) {
+	ring := s.rings[q.priority]
+	for i, x := range ring {
+		if x == q {
+			s.rings[q.priority] = append(ring[:i], ring[i+1:]...)
+			break
+		}
+	}
+	q.served = 0
+}
+
+// next grants the device to the next waiter in line, if any. Called
+// with mtx held by whoever currently has the device.
+func (s *scheduler) next() {
+	if s.depth == 0 {
+		s.busy = false
+		s.holder = ""
+		return
+	}
+
+	top, found := 0, false
+	for p, ring := range s.rings {
+		if len(ring) > 0 && (!found || p > top) {
+			top, found = p, true
+		}
+	}
+	ring := s.rings[top]
+	q := ring[0]
+
+	w := q.waiters[0]
+	q.waiters = q.waiters[1:]
+	q.served++
+	s.depth--
+
+	if len(q.waiters) == 0 {
+		s.dequeue(q)
+	} else if !s.weighted || q.served >= q.weight {
+		s.rings[top] = append(ring[1:], q)
+		q.served = 0
+	}
+
+	q.waitTotal += time.Since(w.enqueued)
+	q.waitCount++
+	s.holder, s.since = w.cid, time.Now()
+	w.granted = true
+	close(w.ready)
+}
+
+type queueStat struct {
+	client string
+	depth  int
+	wait   time.Duration
+	count  uint64
+}
+
+// holding reports the request currently using the device, if any, and
+// for how long it has done so.
+func (s *scheduler) holding() (cid string, held time.Duration, busy bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.busy {
+		return "", 0, false
+	}
+	return s.holder, time.Since(s.since), true
+}
+
+// stats reports the queue depth and cumulative waiting per client, for
+// at most queueStatClients clients and "other".
+func (s *scheduler) stats() (depth int, clients []queueStat) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, q := range s.clients {
+		clients = append(clients, queueStat{
+			client: q.client,
+			depth:  len(q.waiters),
+			wait:   q.waitTotal,
+			count:  q.waitCount,
+		})
+	}
+	if len(clients) > queueStatClients {
+		sort.Slice(clients, func(i, j int) bool {
+			if clients[i].depth != clients[j].depth {
+				return clients[i].depth > clients[j].depth
+			}
+			return clients[i].count > clients[j].count
+		})
+		other := queueStat{client: "other"}
+		for _, c := range clients[queueStatClients:] {
+			other.depth += c.depth
+			other.wait += c.wait
+			other.count += c.count
+		}
+		clients = append(clients[:queueStatClients], other)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].client < clients[j].client })
+	return s.depth, clients
+}
+
+func init() {
+	registry = append(registry, collectorFunc(func(w io.Writer) {
+		depth, clients := deviceScheduler.stats()
+
+		fmt.Fprintf(w, "# HELP yubihsm_connector_queue_depth Requests waiting for the device.\n")
+		fmt.Fprintf(w, "# TYPE yubihsm_connector_queue_depth gauge\n")
+		fmt.Fprintf(w, "yubihsm_connector_queue_depth %d\n", depth)
+		_, held, _ := deviceScheduler.holding()
+		fmt.Fprintf(w, "# HELP yubihsm_connector_device_hold_seconds Time the current request has held the device.\n")
+		fmt.Fprintf(w, "# TYPE yubihsm_connector_device_hold_seconds gauge\n")
+		fmt.Fprintf(w, "yubihsm_connector_device_hold_seconds %g\n", held.Seconds())
+		fmt.Fprintf(w, "# HELP yubihsm_connector_client_queue_depth Requests waiting for the device per client.\n")
+		fmt.Fprintf(w, "# TYPE yubihsm_connector_client_queue_depth gauge\n")
+		for _, c := range clients {
+			fmt.Fprintf(w, "yubihsm_connector_client_queue_depth%s %d\n",
+				labelString([]string{"client"}, []string{c.client}), c.depth)
+		}
+		fmt.Fprintf(w, "# HELP yubihsm_connector_client_queue_wait_seconds Time spent waiting for the device per client.\n")
+		fmt.Fprintf(w, "# TYPE yubihsm_connector_client_queue_wait_seconds summary\n")
+		for _, c := range clients {
+			labels := labelString([]string{"client"}, []string{c.client})
+			fmt.Fprintf(w, "yubihsm_connector_client_queue_wait_seconds_sum%s %g\n", labels, c.wait.Seconds())
+			fmt.Fprintf(w, "yubihsm_connector_client_queue_wait_seconds_count%s %d\n", labels, c.count)
+		}
+	}))
+}
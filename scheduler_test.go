@@ -0,0 +1,388 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// scheduleOrder queues requests from clients, named by single letters in
+// order, behind a holder, and returns the order in which they are served.
+func scheduleOrder(t *testing.T, s *scheduler, clients string, entries map[byte]*policyEntry) string {
+	release, err := s.acquire(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan byte, len(clients))
+	for i := 0; i < len(clients); i++ {
+		c := clients[i]
+		ctx := withIdentity(context.Background(), identity{id: string(c), entry: entries[c]})
+		go func() {
+			release, err := s.acquire(ctx, "test")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			served <- c
+			release()
+		}()
+		// Let each request queue up before the next, so arrival order
+		// is deterministic.
+		for {
+			if depth, _ := s.stats(); depth == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	release()
+	var order strings.Builder
+	for range clients {
+		order.WriteByte(<-served)
+	}
+	return order.String()
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	order := scheduleOrder(t, newScheduler(false), "aaab", nil)
+	if order != "abaa" {
+		t.Fatalf("got %q: expected %q", order, "abaa")
+	}
+}
+
+func TestSchedulerWeighted(t *testing.T) {
+	entries := map[byte]*policyEntry{'a': {Weight: 2}}
+	order := scheduleOrder(t, newScheduler(true), "aaaabb", entries)
+	if order != "aabaab" {
+		t.Fatalf("got %q: expected %q", order, "aabaab")
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	entries := map[byte]*policyEntry{'b': {Priority: 1}}
+	order := scheduleOrder(t, newScheduler(false), "aabb", entries)
+	if order != "bbaa" {
+		t.Fatalf("got %q: expected %q", order, "bbaa")
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	s := newScheduler(false)
+	release, err := s.acquire(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = s.acquire(ctx, "test"); err != context.DeadlineExceeded {
+		t.Fatalf("got %v: expected %v", err, context.DeadlineExceeded)
+	}
+	if depth, _ := s.stats(); depth != 0 {
+		t.Fatalf("got depth %d: expected 0", depth)
+	}
+
+	release()
+	if release, err = s.acquire(context.Background(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestSchedulerBounds(t *testing.T) {
+	v := viper.New()
+	v.Set("max-queue-depth", 1)
+	v.Set("max-queue-wait", 20*time.Millisecond)
+	s, err := loadScheduler(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := s.acquire(context.Background(), "holder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid, _, busy := s.holding(); !busy || cid != "holder" {
+		t.Fatalf("got holder %q, %v: expected holder", cid, busy)
+	}
+
+	waited := make(chan error)
+	go func() {
+		_, err := s.acquire(context.Background(), "waiter")
+		waited <- err
+	}()
+	for {
+		if depth, _ := s.stats(); depth == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err = s.acquire(context.Background(), "shed"); err != errQueueFull {
+		t.Fatalf("got %v: expected %v", err, errQueueFull)
+	}
+	if err = <-waited; err != errQueueTimeout {
+		t.Fatalf("got %v: expected %v", err, errQueueTimeout)
+	}
+	release()
+	if _, _, busy := s.holding(); busy {
+		t.Fatalf("device still held after release")
+	}
+}
+
+func TestSchedulerShedding(t *testing.T) {
+	v := viper.New()
+	v.Set("scheduler", "weighted")
+	v.Set("max-queue-depth", 1)
+	v.Set("max-queue-wait", "50ms")
+	defer func(s *scheduler) { deviceScheduler = s }(deviceScheduler)
+	var err error
+	if deviceScheduler, err = loadScheduler(v); err != nil {
+		t.Fatal(err)
+	} else if !deviceScheduler.weighted {
+		t.Fatal("scheduler is not weighted")
+	}
+
+	defer func(proxy func(context.Context, []byte, string, string) ([]byte, error)) {
+		deviceProxy = proxy
+	}(deviceProxy)
+	deviceProxy = func(ctx context.Context, req []byte, cid string, serial string) ([]byte, error) {
+		release, err := deviceScheduler.acquire(ctx, cid)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return echoDevice(req)
+	}
+
+	release, err := deviceScheduler.acquire(context.Background(), "holder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	post := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/connector/api", bytes.NewReader([]byte{0x01, 0x00, 0x01, 0x00}))
+		apiHandler(w, r, "")
+		return w
+	}
+	var wg sync.WaitGroup
+	var queued *httptest.ResponseRecorder
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		queued = post()
+	}()
+	for {
+		if depth, _ := deviceScheduler.stats(); depth == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if w := post(); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("beyond max-queue-depth got %d", w.Code)
+	}
+	wg.Wait()
+	if queued.Code != http.StatusServiceUnavailable {
+		t.Fatalf("beyond max-queue-wait got %d", queued.Code)
+	}
+}
+
+func TestSchedulerHold(t *testing.T) {
+	s := newScheduler(false)
+	ctx, done, err := s.hold(context.Background(), "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		release, err := s.acquire(context.Background(), "other")
+		if err != nil {
+			t.Error(err)
+		}
+		release()
+		close(waited)
+	}()
+	for {
+		if depth, _ := s.stats(); depth == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Exchanges within the hold don't queue behind the other client.
+	release, err := s.acquire(ctx, "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	select {
+	case <-waited:
+		t.Fatal("device handed on while still in use")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release()
+	<-waited
+
+	if cid, _, busy := s.holding(); busy {
+		t.Fatalf("device still held by %q", cid)
+	}
+}
+
+func TestSchedulerQuiesce(t *testing.T) {
+	s := newScheduler(false)
+	release, err := s.acquire(context.Background(), "holder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refused := make(chan error)
+	go func() {
+		_, err := s.acquire(context.Background(), "queued")
+		refused <- err
+	}()
+	for {
+		if depth, _ := s.stats(); depth == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	quiesced := make(chan error)
+	go func() {
+		quiesced <- s.quiesce(context.Background())
+	}()
+	if err = <-refused; err != errDraining {
+		t.Fatalf("queued request got %v: expected %v", err, errDraining)
+	}
+	if _, err = s.acquire(context.Background(), "late"); err != errDraining {
+		t.Fatalf("late request got %v: expected %v", err, errDraining)
+	}
+	select {
+	case <-quiesced:
+		t.Fatal("quiesced while the device was still in use")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	release()
+	if err = <-quiesced; err != nil {
+		t.Fatal(err)
+	}
+	if cid, _, _ := s.holding(); cid != "drain" {
+		t.Fatalf("device held by %q: expected drain", cid)
+	}
+}
+
+func TestSchedulerForgetsIdle(t *testing.T) {
+	s := newScheduler(false)
+	for i := 0; i < queueStatClients+5; i++ {
+		ctx := withIdentity(context.Background(), identity{id: fmt.Sprintf("ip:192.0.2.%d", i)})
+		release, err := s.acquire(ctx, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+
+	_, clients := s.stats()
+	if len(clients) != queueStatClients+1 || clients[len(clients)-1].client != "other" {
+		t.Fatalf("got %d clients, last %q: expected %d and other", len(clients), clients[len(clients)-1].client, queueStatClients+1)
+	}
+	var count uint64
+	for _, c := range clients {
+		count += c.count
+	}
+	if count != queueStatClients+5 {
+		t.Fatalf("got %d requests: expected %d", count, queueStatClients+5)
+	}
+
+	s.mtx.Lock()
+	idle := time.Now().Add(-2 * clientQueueIdle)
+	s.swept = idle
+	for _, q := range s.clients {
+		q.lastSeen = idle
+	}
+	s.mtx.Unlock()
+
+	release, err := s.acquire(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if _, clients = s.stats(); len(clients) != 1 {
+		t.Fatalf("got %v: expected idle clients forgotten", clients)
+	}
+}
+
+func TestSchedulerShutdown(t *testing.T) {
+	s := newScheduler(false)
+	release, err := s.acquire(context.Background(), "stuck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := s.abortable(context.Background())
+	defer stop()
+	aborted := make(chan struct{})
+	go func() {
+		// A request in the middle of I/O, which lets go of the device
+		// only once cut off.
+		<-ctx.Done()
+		close(aborted)
+		release()
+	}()
+
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = s.shutdown(timeout, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-aborted:
+	default:
+		t.Fatal("device released without the holder being cut off")
+	}
+	if cid, _, _ := s.holding(); cid != "drain" {
+		t.Fatalf("device held by %q: expected drain", cid)
+	}
+
+	// A holder that doesn't let go keeps the device.
+	s = newScheduler(false)
+	if release, err = s.acquire(context.Background(), "stuck"); err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	timeout, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = s.shutdown(timeout, 10*time.Millisecond); err == nil {
+		t.Fatal("shut down with the device still in use")
+	}
+	if cid, _, _ := s.holding(); cid != "stuck" {
+		t.Fatalf("device held by %q: expected stuck", cid)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sender exchanges a single raw frame with a device, either directly over
+// usb or through a remote connector.
+type sender func(req []byte) ([]byte, error)
+
+func usbSender(serial string) sender {
+	return func(req []byte) ([]byte, error) {
+		cid, err := uuidv4()
+		if err != nil {
+			cid = "-"
+		}
+		return deviceProxy(context.Background(), req, cid, serial)
+	}
+}
+
+func httpSender(url string) sender {
+	url = strings.TrimSuffix(url, "/")
+	if !strings.HasSuffix(url, "/connector/api") {
+		url += "/connector/api"
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	return func(req []byte) ([]byte, error) {
+		resp, err := client.Post(url, "application/octet-stream", bytes.NewReader(req))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		buf, err := io.ReadAll(io.LimitReader(resp.Body, 8192))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(buf)))
+		}
+		return buf, nil
+	}
+}
+
+// sendFrame sends req and prints both frames along with the round-trip time.
+func sendFrame(w io.Writer, send sender, req []byte) error {
+	decodeFrame(w, req)
+
+	now := time.Now()
+	resp, err := send(req)
+	latency := time.Since(now)
+	if err != nil {
+		return err
+	}
+
+	decodeFrame(w, resp)
+	fmt.Fprintf(w, "  time: %s\n", latency)
+	return nil
+}
+
+// buildFrame prepends the CMD and LEN header to data.
+func buildFrame(cmd byte, data []byte) []byte {
+	buf := make([]byte, frameHeaderLen, frameHeaderLen+len(data))
+	buf[0] = cmd
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(data)))
+	return append(buf, data...)
+}
+
+const sendHelp = `commands:
+  echo [hex]   send an Echo with the given data (default "hello")
+  info         send a DeviceInfo
+  <hex>        send a raw frame
+  quit         leave
+`
+
+// sendREPL reads commands from rd until EOF or quit.
+func sendREPL(w io.Writer, rd io.Reader, send sender) error {
+	scanner := bufio.NewScanner(rd)
+
+	fmt.Fprint(w, "send> ")
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		var req []byte
+		var err error
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "quit" || fields[0] == "exit":
+			return nil
+		case fields[0] == "help":
+			fmt.Fprint(w, sendHelp)
+		case fields[0] == "echo":
+			data := []byte("hello")
+			if len(fields) > 1 {
+				data, err = decodeHex(strings.Join(fields[1:], ""))
+			}
+			req = buildFrame(cmdEcho, data)
+		case fields[0] == "info":
+			req = buildFrame(cmdDeviceInfo, nil)
+		default:
+			req, err = decodeHex(strings.Join(fields, ""))
+		}
+
+		if err == nil && req != nil {
+			err = sendFrame(w, send, req)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "error: %s\n", err)
+		}
+		fmt.Fprint(w, "send> ")
+	}
+
+	return scanner.Err()
+}
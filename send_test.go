@@ -0,0 +1,95 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoDevice answers a request with the same data as a response to it.
+func echoDevice(req []byte) ([]byte, error) {
+	resp := append([]byte(nil), req...)
+	resp[0] |= cmdResponse
+	return resp, nil
+}
+
+func TestHTTPSender(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/connector/api" {
+			http.NotFound(w, r)
+			return
+		}
+		req, _ := io.ReadAll(r.Body)
+		if len(req) == 0 {
+			http.Error(w, "empty frame", http.StatusBadRequest)
+			return
+		}
+		resp, _ := echoDevice(req)
+		w.Write(resp)
+	}))
+	defer ts.Close()
+
+	send := httpSender(ts.URL + "/")
+	req := []byte{0x01, 0x00, 0x02, 0xca, 0xfe}
+	var out bytes.Buffer
+	if err := sendFrame(&out, send, req); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"> Echo", "< Echo", "cafe", "time:"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	if _, err := send(nil); err == nil || !strings.Contains(err.Error(), "400 Bad Request: empty frame") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestSendREPL(t *testing.T) {
+	var sent [][]byte
+	send := func(req []byte) ([]byte, error) {
+		sent = append(sent, req)
+		return echoDevice(req)
+	}
+
+	var out bytes.Buffer
+	in := strings.NewReader("echo\necho cafe\ninfo\n\nnonsense\nquit\necho\n")
+	if err := sendREPL(&out, in, send); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]byte{
+		{cmdEcho, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'},
+		{cmdEcho, 0x00, 0x02, 0xca, 0xfe},
+		{cmdDeviceInfo, 0x00, 0x00},
+	}
+	if len(sent) != len(want) {
+		t.Fatalf("sent %x: expected %x", sent, want)
+	}
+	for i := range want {
+		if !bytes.Equal(sent[i], want[i]) {
+			t.Errorf("frame %d: got %x: expected %x", i, sent[i], want[i])
+		}
+	}
+	if !strings.Contains(out.String(), "error: ") {
+		t.Errorf("invalid hex was not reported:\n%s", out.String())
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build windows
+// +build windows
+
+package main
+
+import "net"
+
+// listenPrivate binds a Unix domain socket at path. Access to it is
+// governed by the ACL of its directory, socket modes don't apply.
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,291 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The first file descriptor passed by socket activation, see
+// sd_listen_fds(3).
+const listenFDsStart = 3
+
+// upgradeEnv names the descriptor a process started by an upgrade reports
+// ready on, see upgradeReady. Such a process gets sockets the way the
+// service manager passes them, but without LISTEN_PID.
+const upgradeEnv = "YUBIHSM_CONNECTOR_UPGRADE"
+
+// How often the device is probed for the service manager when it does not
+// ask for watchdog keepalives.
+const deviceProbeInterval = 30 * time.Second
+
+// activatedSocket is a socket passed by the service manager.
+type activatedSocket struct {
+	name string
+	ln   net.Listener
+}
+
+var activated struct {
+	once    sync.Once
+	mtx     sync.Mutex
+	sockets []activatedSocket
+}
+
+// socketActivation returns the sockets passed in the LISTEN_FDS, PID and
+// FDNAMES environment variables, starting at the descriptor first.
+// Sockets meant for another process are left alone.
+func socketActivation(pid string, fds string, names string, first int) ([]activatedSocket, error) {
+	if fds == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	nameList := strings.Split(names, ":")
+	var sockets []activatedSocket
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("fd %d", first+i)
+		if i < len(nameList) && nameList[i] != "" {
+			name = nameList[i]
+		}
+		f := os.NewFile(uintptr(first+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, s := range sockets {
+				s.ln.Close()
+			}
+			return nil, fmt.Errorf("socket %s: %w", name, err)
+		}
+		sockets = append(sockets, activatedSocket{name: name, ln: ln})
+	}
+	return sockets, nil
+}
+
+// inheritedListener returns the socket passed by the service manager that
+// is bound to addr, if any. Each socket is handed out once.
+func inheritedListener(addr string) net.Listener {
+	activated.once.Do(func() {
+		pid := os.Getenv("LISTEN_PID")
+		if os.Getenv(upgradeEnv) != "" {
+			pid = strconv.Itoa(os.Getpid())
+		}
+		var err error
+		activated.sockets, err = socketActivation(pid, os.Getenv("LISTEN_FDS"),
+			os.Getenv("LISTEN_FDNAMES"), listenFDsStart)
+		if err != nil {
+			log.WithError(err).Warn("ignoring sockets passed by the service manager")
+		}
+		for _, s := range activated.sockets {
+			log.WithFields(log.Fields{
+				"name": s.name,
+				"addr": s.ln.Addr().String(),
+			}).Debug("socket passed by the service manager")
+		}
+		// Keep them from being passed on to any child.
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+
+	activated.mtx.Lock()
+	defer activated.mtx.Unlock()
+
+	for i, s := range activated.sockets {
+		if s.ln != nil && boundTo(s.ln.Addr(), addr) {
+			activated.sockets[i].ln = nil
+			return s.ln
+		}
+	}
+	return nil
+}
+
+// unusedSockets closes the sockets passed by the service manager that no
+// listener is bound to, warning about each.
+func unusedSockets() {
+	activated.mtx.Lock()
+	defer activated.mtx.Unlock()
+
+	for i, s := range activated.sockets {
+		if s.ln == nil {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"name": s.name,
+			"addr": s.ln.Addr().String(),
+		}).Warn("no listener for socket passed by the service manager")
+		s.ln.Close()
+		activated.sockets[i].ln = nil
+	}
+}
+
+// boundTo reports whether a socket bound to a serves the listen address
+// addr.
+func boundTo(a net.Addr, addr string) bool {
+	if isUnixAddr(addr) {
+		return a.Network() == "unix" && a.String() == strings.TrimPrefix(addr, unixPrefix)
+	}
+	got, ok := a.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != strconv.Itoa(got.Port) {
+		return false
+	}
+	if host == "" {
+		return got.IP.IsUnspecified()
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(got.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// sdNotify sends state to the service manager, when it asked for it, see
+// sd_notify(3).
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// Abstract socket names, starting with @, are handled by net.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often the service manager expects watchdog
+// keepalives, or 0 if it does not.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// probeDevice checks on the device, giving up after timeout, and returns
+// its state as a STATUS= line. A device busy answering others is taken
+// to be alive rather than probed, as the probe would queue behind them;
+// only a request that has held it for longer than timeout suggests it
+// stopped answering.
+func probeDevice(ctx context.Context, timeout time.Duration) (status string, ok bool) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	serial := currentSerial()
+	device := "Device"
+	if serial != "" {
+		device += " " + serial
+	}
+	if _, held, busy := deviceScheduler.holding(); busy && held < timeout {
+		return "STATUS=" + device + " busy", true
+	}
+
+	err := deviceCheck(ctx, "device-probe", serial)
+	switch {
+	case errors.Is(err, errQueueFull), errors.Is(err, errQueueTimeout):
+		return "STATUS=" + device + " busy", true
+	case err != nil:
+		log.WithError(err).Debug("device probe failed")
+		return "STATUS=Device unavailable: " + err.Error(), false
+	}
+	return "STATUS=" + device + " ready", true
+}
+
+// serviceNotify tells the service manager the connector is ready, along
+// with the state of the device, and keeps probing the device in the
+// background until ctx is done. Watchdog keepalives are only sent after a
+// successful probe, so the service manager may restart a connector whose
+// device stopped answering.
+func serviceNotify(ctx context.Context) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	interval, watchdog := watchdogInterval()/2, true
+	if interval <= 0 {
+		interval, watchdog = deviceProbeInterval, false
+	}
+
+	status, _ := probeDevice(ctx, interval)
+	if err := sdNotify("READY=1\n" + status); err != nil {
+		log.WithError(err).Warn("couldn't notify the service manager")
+		return
+	}
+	log.WithFields(log.Fields{
+		"status":   strings.TrimPrefix(status, "STATUS="),
+		"interval": interval,
+		"watchdog": watchdog,
+	}).Debug("notified the service manager")
+
+	go deviceMonitor(ctx, interval, watchdog)
+}
+
+// deviceMonitor probes the device every interval until ctx is done,
+// passing on its state and, with watchdog, a keepalive when it answers.
+func deviceMonitor(ctx context.Context, interval time.Duration, watchdog bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		state, ok := probeDevice(ctx, interval)
+		if ctx.Err() != nil {
+			return
+		}
+		if ok && watchdog {
+			state += "\nWATCHDOG=1"
+		}
+		if err := sdNotify(state); err != nil {
+			log.WithError(err).Warn("couldn't notify the service manager")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket stands in for the service manager's notification
+// socket.
+func fakeNotifySocket(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestServiceNotify(t *testing.T) {
+	conn := fakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	defer func(check func(context.Context, string, string) error) {
+		deviceCheck = check
+	}(deviceCheck)
+	var fail atomic.Bool
+	deviceCheck = func(ctx context.Context, cid string, serial string) error {
+		if fail.Load() {
+			return errors.New("unplugged")
+		}
+		return nil
+	}
+
+	defer deviceSerial.Store(currentSerial())
+	deviceSerial.Store("0012345")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serviceNotify(ctx)
+
+	if msg := readNotify(t, conn); msg != "READY=1\nSTATUS=Device 0012345 ready" {
+		t.Fatalf("got %q", msg)
+	}
+	if msg := readNotify(t, conn); msg != "STATUS=Device 0012345 ready\nWATCHDOG=1" {
+		t.Fatalf("got %q", msg)
+	}
+
+	fail.Store(true)
+	for {
+		msg := readNotify(t, conn)
+		if strings.Contains(msg, "unplugged") {
+			if strings.Contains(msg, "WATCHDOG=1") {
+				t.Fatalf("got %q: watchdog kept alive without the device", msg)
+			}
+			break
+		}
+	}
+}
+
+func TestProbeDeviceBusy(t *testing.T) {
+	defer func(s *scheduler) { deviceScheduler = s }(deviceScheduler)
+	deviceScheduler = newScheduler(false)
+	defer func(check func(context.Context, string, string) error) {
+		deviceCheck = check
+	}(deviceCheck)
+	var checkErr error
+	deviceCheck = func(ctx context.Context, cid string, serial string) error {
+		return checkErr
+	}
+	defer deviceSerial.Store(currentSerial())
+	deviceSerial.Store("")
+
+	release, err := deviceScheduler.acquire(context.Background(), "holder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr = errors.New("not probed while busy")
+	if status, ok := probeDevice(context.Background(), time.Minute); !ok || status != "STATUS=Device busy" {
+		t.Fatalf("got %q, %v while in use", status, ok)
+	}
+	if status, ok := probeDevice(context.Background(), time.Nanosecond); ok {
+		t.Fatalf("got %q, %v while held too long", status, ok)
+	}
+	release()
+
+	checkErr = errQueueTimeout
+	if status, ok := probeDevice(context.Background(), time.Minute); !ok || status != "STATUS=Device busy" {
+		t.Fatalf("got %q, %v behind a queue", status, ok)
+	}
+}
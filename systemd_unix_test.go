@@ -0,0 +1,63 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestSocketActivation(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// socketActivation closes the descriptors it is passed, so pass it
+	// one f doesn't own.
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pid := strconv.Itoa(os.Getpid())
+	if sockets, err := socketActivation("1", "1", "", fd); err != nil || sockets != nil {
+		t.Fatalf("got %v, %v for another process", sockets, err)
+	}
+	sockets, err := socketActivation(pid, "1", "api", fd)
+	if err != nil || len(sockets) != 1 {
+		t.Fatalf("got %v, %v", sockets, err)
+	}
+	defer sockets[0].ln.Close()
+
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	if sockets[0].name != "api" || !boundTo(sockets[0].ln.Addr(), "localhost:"+port) {
+		t.Fatalf("got %s bound to %s", sockets[0].name, sockets[0].ln.Addr())
+	}
+	if boundTo(sockets[0].ln.Addr(), "localhost:1") || boundTo(sockets[0].ln.Addr(), "unix:/run/x") {
+		t.Fatalf("%s bound to other addresses", sockets[0].ln.Addr())
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/fips140"
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// tlsSettings are the protocol versions, cipher suites and such the TLS
+// listeners allow. Those left zero are up to crypto/tls.
+type tlsSettings struct {
+	minVersion       uint16
+	maxVersion       uint16
+	cipherSuites     []uint16
+	curves           []tls.CurveID
+	noSessionTickets bool
+}
+
+// TLS settings for all listeners, set by Start.
+var serverTLS = &tlsSettings{}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+}
+
+// TLS 1.2 cipher suites with forward secrecy and authenticated encryption.
+var ecdheAEADSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// tlsProfile returns the settings of a named profile, which the
+// individual settings refine.
+func tlsProfile(name string) (*tlsSettings, error) {
+	switch name {
+	case "":
+		return &tlsSettings{}, nil
+	case "modern":
+		return &tlsSettings{minVersion: tls.VersionTLS13}, nil
+	case "compatible":
+		return &tlsSettings{
+			minVersion:   tls.VersionTLS12,
+			cipherSuites: ecdheAEADSuites,
+		}, nil
+	case "fips-approved":
+		s := &tlsSettings{
+			minVersion:   tls.VersionTLS12,
+			cipherSuites: ecdheAEADSuites[:4], // AES-GCM only
+			curves:       []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521},
+		}
+		// The TLS 1.3 cipher suites can't be chosen, and only keep to
+		// approved ones in FIPS 140-3 mode.
+		if !fips140.Enabled() {
+			s.maxVersion = tls.VersionTLS12
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown tls-profile %q", name)
+	}
+}
+
+// loadTLSSettings returns the TLS settings configured in v.
+func loadTLSSettings(v *viper.Viper) (*tlsSettings, error) {
+	s, err := tlsProfile(v.GetString("tls-profile"))
+	if err != nil {
+		return nil, err
+	}
+
+	for key, version := range map[string]*uint16{
+		"tls-min-version": &s.minVersion,
+		"tls-max-version": &s.maxVersion,
+	} {
+		if name := v.GetString(key); name != "" {
+			if !strings.Contains(name, ".") {
+				name += ".0" // as YAML reads 1.0
+			}
+			var ok bool
+			if *version, ok = tlsVersions[name]; !ok {
+				return nil, fmt.Errorf("unknown %s %q, expected 1.0, 1.1, 1.2 or 1.3", key, name)
+			}
+		}
+	}
+	if s.maxVersion != 0 && s.minVersion > s.maxVersion {
+		return nil, fmt.Errorf("tls-min-version is above tls-max-version")
+	}
+
+	if names := v.GetStringSlice("tls-cipher-suites"); len(names) > 0 {
+		s.cipherSuites = nil
+	next:
+		for _, name := range names {
+			for _, suite := range tls.CipherSuites() {
+				if suite.Name == name {
+					s.cipherSuites = append(s.cipherSuites, suite.ID)
+					continue next
+				}
+			}
+			for _, suite := range tls.InsecureCipherSuites() {
+				if suite.Name == name {
+					return nil, fmt.Errorf("cipher suite %s is insecure", name)
+				}
+			}
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+	}
+
+	if names := v.GetStringSlice("tls-curves"); len(names) > 0 {
+		s.curves = nil
+		for _, name := range names {
+			curve, ok := tlsCurves[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown curve %q", name)
+			}
+			s.curves = append(s.curves, curve)
+		}
+	}
+
+	if v.IsSet("tls-session-tickets") {
+		s.noSessionTickets = !v.GetBool("tls-session-tickets")
+	}
+	return s, nil
+}
+
+// config returns a TLS configuration with the settings, for a server to
+// add its certificate to.
+func (s *tlsSettings) config() *tls.Config {
+	return &tls.Config{
+		MinVersion:             s.minVersion,
+		MaxVersion:             s.maxVersion,
+		CipherSuites:           s.cipherSuites,
+		CurvePreferences:       s.curves,
+		SessionTicketsDisabled: s.noSessionTickets,
+	}
+}
+
+// weakTLS returns what is weak about a negotiated TLS connection, if
+// anything: a version before 1.2, or a cipher suite without forward
+// secrecy or authenticated encryption.
+func weakTLS(state *tls.ConnectionState) string {
+	if state.Version < tls.VersionTLS12 {
+		return "version"
+	}
+	if state.Version >= tls.VersionTLS13 {
+		return ""
+	}
+	for _, suite := range ecdheAEADSuites {
+		if suite == state.CipherSuite {
+			return ""
+		}
+	}
+	return "cipher suite"
+}
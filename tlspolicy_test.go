@@ -0,0 +1,136 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func loadTestTLSSettings(t *testing.T, config string) (*tlsSettings, error) {
+	return loadTLSSettings(testConfig(t, config))
+}
+
+func TestTLSSettings(t *testing.T) {
+	for _, test := range []struct {
+		config   string
+		settings tlsSettings
+	}{
+		{"", tlsSettings{}},
+		{"tls-profile: modern", tlsSettings{minVersion: tls.VersionTLS13}},
+		{"tls-profile: compatible\ntls-max-version: 1.2", tlsSettings{
+			minVersion:   tls.VersionTLS12,
+			maxVersion:   tls.VersionTLS12,
+			cipherSuites: ecdheAEADSuites,
+		}},
+		{"tls-profile: fips-approved\ntls-curves: [P-384]", tlsSettings{
+			minVersion:   tls.VersionTLS12,
+			maxVersion:   tls.VersionTLS12,
+			cipherSuites: ecdheAEADSuites[:4],
+			curves:       []tls.CurveID{tls.CurveP384},
+		}},
+		{"tls-min-version: 1.0\ntls-cipher-suites: [TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA]", tlsSettings{
+			minVersion:   tls.VersionTLS10,
+			cipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+		}},
+		{"tls-session-tickets: false", tlsSettings{noSessionTickets: true}},
+	} {
+		s, err := loadTestTLSSettings(t, test.config)
+		if err != nil {
+			t.Fatalf("%q: %v", test.config, err)
+		}
+		if !reflect.DeepEqual(*s, test.settings) {
+			t.Errorf("%q: got %+v, wanted %+v", test.config, *s, test.settings)
+		}
+	}
+}
+
+func TestTLSSettingsInvalid(t *testing.T) {
+	for _, config := range []string{
+		"tls-profile: legacy",
+		"tls-min-version: 1.4",
+		"tls-min-version: \"1.3\"\ntls-max-version: \"1.2\"",
+		"tls-profile: modern\ntls-max-version: 1.2",
+		"tls-cipher-suites: [TLS_RSA_WITH_RC4_128_SHA]",
+		"tls-cipher-suites: [nonsense]",
+		"tls-curves: [P-224]",
+	} {
+		if _, err := loadTestTLSSettings(t, config); err == nil {
+			t.Errorf("%q was accepted", config)
+		}
+	}
+}
+
+func TestWeakTLS(t *testing.T) {
+	for _, test := range []struct {
+		version uint16
+		suite   uint16
+		weak    string
+	}{
+		{tls.VersionTLS13, tls.TLS_AES_128_GCM_SHA256, ""},
+		{tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, ""},
+		{tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, "cipher suite"},
+		{tls.VersionTLS12, tls.TLS_RSA_WITH_AES_128_GCM_SHA256, "cipher suite"},
+		{tls.VersionTLS11, tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, "version"},
+	} {
+		state := &tls.ConnectionState{Version: test.version, CipherSuite: test.suite}
+		if weak := weakTLS(state); weak != test.weak {
+			t.Errorf("%s %s: got %q", tls.VersionName(test.version), tls.CipherSuiteName(test.suite), weak)
+		}
+	}
+}
+
+func TestTLSSettingsServed(t *testing.T) {
+	cert, key := writeTestCertificate(t, t.TempDir(), "localhost", time.Now().Add(time.Hour))
+	listeners, err := loadTestListeners(t, `listeners: [{listen: "localhost:1", cert: `+cert+`, key: `+key+`}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(s *tlsSettings) { serverTLS = s }(serverTLS)
+	if serverTLS, err = loadTestTLSSettings(t, "tls-profile: modern"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, _, err := listeners[0].server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.TLS = srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	for _, test := range []struct {
+		version uint16
+		ok      bool
+	}{
+		{tls.VersionTLS12, false},
+		{tls.VersionTLS13, true},
+	} {
+		conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         test.version,
+		})
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v", tls.VersionName(test.version), err)
+		}
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/Yubico/yubihsm-connector"
+
+// tracer is backed by a no-op provider until tracingInit installs one, so
+// spans may be started unconditionally.
+var tracer = otel.Tracer(tracerName)
+
+// tracingInit configures span export over OTLP/HTTP to endpoint, or to a
+// local file, and returns a function flushing and stopping the exporter.
+// W3C trace context is always accepted from incoming requests.
+func tracingInit(endpoint string, file string) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var exporter sdktrace.SpanExporter
+	var processor sdktrace.TracerProviderOption
+	switch {
+	case endpoint != "":
+		exporter, err = otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpointURL(endpoint))
+		processor = sdktrace.WithBatcher(exporter)
+	case file != "":
+		// Spans are written synchronously so that nothing is lost when
+		// the process is stopped abruptly during a test.
+		var f *os.File
+		if f, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		processor = sdktrace.WithSyncer(exporter)
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "yubihsm-connector"),
+			attribute.String("service.version", Version.String()),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	// The global provider only delegates to the first one installed.
+	tracer = provider.Tracer(tracerName)
+
+	return provider.Shutdown, nil
+}
+
+func startSpan(ctx context.Context, name string, cid string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("yubihsm.request_id", cid))
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
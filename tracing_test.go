@@ -0,0 +1,152 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gousb"
+)
+
+// testEndpoints stand in for the endpoints of a device that echoes each
+// command back as its response.
+type testEndpoints struct {
+	last []byte
+}
+
+func (e *testEndpoints) WriteContext(ctx context.Context, buf []byte) (int, error) {
+	if len(buf) > 0 {
+		e.last = append([]byte(nil), buf...)
+	}
+	return len(buf), nil
+}
+
+func (e *testEndpoints) ReadContext(ctx context.Context, buf []byte) (int, error) {
+	resp, _ := echoDevice(e.last)
+	return copy(buf, resp), nil
+}
+
+// testSpan is a span as written by the file exporter.
+type testSpan struct {
+	Name        string
+	SpanContext struct{ TraceID string }
+	Parent      struct{ TraceID string }
+	Attributes  []struct {
+		Key   string
+		Value struct{ Value interface{} }
+	}
+}
+
+func (s testSpan) attribute(key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.Value
+		}
+	}
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := tracingInit("", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend a device is open, as usbopen leaves it.
+	const serial = "0012345678"
+	endpoints := &testEndpoints{}
+	state.ctx, state.device, state.serial = &gousb.Context{}, &gousb.Device{}, serial
+	state.wendpoint, state.rendpoint = endpoints, endpoints
+	defer func() {
+		state.ctx, state.device, state.serial = nil, nil, ""
+		state.wendpoint, state.rendpoint = nil, nil
+	}()
+	defer deviceSerial.Store(currentSerial())
+	deviceSerial.Store(serial)
+
+	listeners, err := loadTestListeners(t, `listeners: [{listen: "localhost:1", routes: [api]}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _, err := listeners[0].server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.Config.BaseContext = srv.BaseContext
+	ts.Start()
+	defer ts.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	frame := []byte{0x01, 0x00, 0x02, 0xca, 0xfe}
+	req, _ := http.NewRequest("POST", ts.URL+"/connector/api", bytes.NewReader(frame))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	req.Header.Set("X-Request-ID", "trace-test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want, _ := echoDevice(frame); !bytes.Equal(body, want) {
+		t.Fatalf("got %d %x: expected %x", resp.StatusCode, body, want)
+	}
+	if err = shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	spans := map[string]testSpan{}
+	for dec := json.NewDecoder(f); dec.More(); {
+		var span testSpan
+		if err = dec.Decode(&span); err != nil {
+			t.Fatal(err)
+		}
+		spans[span.Name] = span
+	}
+
+	for _, name := range []string{"POST /connector/api", "usb lock", "usb write", "usb read"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %q span among %v", name, spans)
+			continue
+		}
+		if span.SpanContext.TraceID != traceID || span.Parent.TraceID != traceID {
+			t.Errorf("%s: trace %s, parent trace %s: expected %s", name, span.SpanContext.TraceID, span.Parent.TraceID, traceID)
+		}
+		if id := span.attribute("yubihsm.request_id"); id != "trace-test" {
+			t.Errorf("%s: got request id %v", name, id)
+		}
+		if s := span.attribute("yubihsm.serial"); s != serial {
+			t.Errorf("%s: got serial %v", name, s)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Listen addresses with this prefix name a Unix domain socket.
+const unixPrefix = "unix:"
+
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, unixPrefix)
+}
+
+// socketConfig is how a Unix domain socket is to be created.
+type socketConfig struct {
+	mode os.FileMode
+	// Owner and group, -1 to leave unchanged.
+	uid, gid int
+}
+
+// parseSocketConfig parses the socket mode, in octal, and owner, as one
+// of user, user:group or :group, by name or ID.
+func parseSocketConfig(mode string, owner string) (c socketConfig, err error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return c, fmt.Errorf("invalid socket mode %q", mode)
+	}
+	c.mode = os.FileMode(m)
+
+	c.uid, c.gid = -1, -1
+	if owner == "" {
+		return c, nil
+	}
+	u, g, _ := strings.Cut(owner, ":")
+	if u != "" {
+		if c.uid, err = lookupID("uid", u); err != nil {
+			return c, err
+		}
+	}
+	if g != "" {
+		if c.gid, err = lookupID("gid", g); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// lookupID resolves a user or group, by name or ID.
+func lookupID(kind string, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+	var id string
+	if kind == "uid" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, err
+		}
+		id = u.Uid
+	} else {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return 0, err
+		}
+		id = g.Gid
+	}
+	return strconv.Atoi(id)
+}
+
+// listenUnix creates a Unix domain socket at path, with the mode and
+// owner in c. A socket left behind by an earlier run is replaced. The
+// socket is only opened up once it has its owner, so nobody else gets to
+// connect in between, or at all should that fail.
+func listenUnix(path string, c socketConfig) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.uid >= 0 || c.gid >= 0 {
+		err = os.Chown(path, c.uid, c.gid)
+	}
+	if err == nil {
+		err = os.Chmod(path, c.mode)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// peerCred identifies the process at the other end of a Unix domain
+// socket.
+type peerCred struct {
+	uid uint32
+	gid uint32
+	pid int32
+}
+
+type unixPeerKey struct{}
+
+// connContext notes the credentials of peers connecting over Unix domain
+// sockets, for http.Server.ConnContext.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(interface{ NetConn() net.Conn }); ok {
+		c = tc.NetConn()
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	cred, err := readPeerCred(uc)
+	if err != nil {
+		log.WithError(err).Debug("couldn't read peer credentials")
+		cred = nil
+	}
+	return context.WithValue(ctx, unixPeerKey{}, cred)
+}
+
+// unixPeer reports whether the request in ctx arrived over a Unix domain
+// socket, and the credentials of the peer if they could be read.
+func unixPeer(ctx context.Context) (cred *peerCred, ok bool) {
+	cred, ok = ctx.Value(unixPeerKey{}).(*peerCred)
+	return cred, ok
+}
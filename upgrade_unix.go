@@ -0,0 +1,247 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long a new process has to get ready, and the old one to drain, in
+// an upgrade.
+const upgradeTimeout = time.Minute
+
+// handleUpgrades hands over to a new process, started from the current
+// executable with the same arguments, on SIGUSR2.
+func (p *program) handleUpgrades() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+
+	go func() {
+		for range ch {
+			if err := p.upgrade(); err != nil {
+				log.WithError(err).Error("upgrade failed, carrying on")
+			}
+		}
+	}()
+}
+
+// upgrade passes the listening sockets to a new process the way the
+// service manager does, see socketActivation, along with one end of a
+// socket pair. Once the new process reports ready on it, requests in
+// flight are drained and the device released, which the new process
+// waits for before reaching the device, and the old process exits. A
+// device that can't be released is left to the old process exiting.
+func (p *program) upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, ln := range p.sockets {
+		if pl, ok := ln.(*proxyListener); ok {
+			ln = pl.Listener
+		}
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("can't pass on %s listener", ln.Addr().Network())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		names = append(names, "listener-"+strconv.Itoa(i))
+	}
+
+	ours, theirs, err := upgradeSocketPair()
+	if err != nil {
+		return err
+	}
+	defer ours.Close()
+
+	env := []string{
+		"LISTEN_FDS=" + strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES=" + strings.Join(names, ":"),
+		upgradeEnv + "=" + strconv.Itoa(listenFDsStart+len(files)),
+	}
+	for _, kv := range os.Environ() {
+		switch name, _, _ := strings.Cut(kv, "="); name {
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID", upgradeEnv:
+		default:
+			env = append(env, kv)
+		}
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, theirs)
+	cmd.Env = env
+	err = cmd.Start()
+	theirs.Close()
+	if err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	go cmd.Wait()
+	log.WithFields(log.Fields{
+		"pid":     pid,
+		"sockets": len(files),
+	}).Info("started new process for upgrade")
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := ours.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("new process %d not ready: %w", pid, err)
+	}
+
+	log.WithField("pid", pid).Info("new process ready, draining")
+	sdNotify(fmt.Sprintf("MAINPID=%d\nSTATUS=Handing over to %d", pid, pid))
+	if p.stopMonitor != nil {
+		p.stopMonitor()
+	}
+
+	// The new process serves Unix domain sockets from the same file.
+	for _, ln := range p.sockets {
+		if pl, ok := ln.(*proxyListener); ok {
+			ln = pl.Listener
+		}
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	// As in Stop, requests waiting for the device are refused while those
+	// in flight are drained.
+	deviceScheduler.refuse()
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeTimeout)
+	defer cancel()
+	if err = p.shutdown(ctx); err != nil {
+		log.WithError(err).Warn("requests still in flight after draining")
+	}
+
+	// Wait out whoever holds the device, such as a WebSocket, which
+	// outlives the servers, cutting it off if need be, and keep it.
+	dctx, dcancel := context.WithTimeout(context.Background(), upgradeTimeout)
+	defer dcancel()
+	if err = deviceScheduler.shutdown(dctx, abortGrace); err != nil {
+		// Neither closing the device under the request still using it,
+		// nor having the new process claim it meanwhile, is safe. The
+		// new process gets it once we, and the request, are gone.
+		cid, held, _ := deviceScheduler.holding()
+		log.WithError(err).WithFields(log.Fields{
+			"Correlation-ID": cid,
+			"held":           held,
+		}).Warn("device still in use after draining, exiting without handing it over")
+	} else {
+		usbclose("upgrade")
+		ours.Write([]byte{1})
+	}
+
+	if rec != nil {
+		rec.close()
+	}
+	if p.traceShutdown != nil {
+		p.traceShutdown(context.Background())
+	}
+	log.WithField("pid", pid).Info("handed over to new process")
+	os.Exit(0)
+	return nil
+}
+
+// upgradeSocketPair returns the ends of a connected socket pair, neither
+// of which is inherited by child processes unless passed on explicitly.
+func upgradeSocketPair() (ours *os.File, theirs *os.File, err error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(fds[0]), "upgrade"), os.NewFile(uintptr(fds[1]), "upgrade"), nil
+}
+
+// upgradeReady, in a process started by upgrade, reports it ready to the
+// old process. Until the old process has released the device, it is held
+// here, so requests wait for it.
+func upgradeReady() error {
+	v := os.Getenv(upgradeEnv)
+	if v == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeEnv)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < listenFDsStart {
+		return fmt.Errorf("invalid %s %q", upgradeEnv, v)
+	}
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "upgrade")
+
+	release, err := deviceScheduler.acquire(context.Background(), "upgrade")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	log.WithField("ppid", os.Getppid()).Info("waiting for the old process to release the device")
+	if _, err = f.Write([]byte{1}); err != nil {
+		release()
+		f.Close()
+		return err
+	}
+
+	go func() {
+		defer f.Close()
+		// The old process writes once it is done, or exits.
+		f.Read(make([]byte, 1))
+		release()
+		log.Info("device released by the old process")
+	}()
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUpgradeReady(t *testing.T) {
+	ours, theirs, err := upgradeSocketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ours.Close()
+	defer theirs.Close()
+	// upgradeReady takes over the descriptor it is passed, so pass it one
+	// theirs doesn't own.
+	fd, err := syscall.Dup(int(theirs.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(upgradeEnv, strconv.Itoa(fd))
+
+	if err = upgradeReady(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ours.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("no readiness reported: %v", err)
+	}
+
+	// The device stays held for the old process until it is released.
+	acquired := make(chan struct{})
+	go func() {
+		release, err := deviceScheduler.acquire(context.Background(), "test")
+		if err != nil {
+			t.Error(err)
+		} else {
+			release()
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("device acquired before the old process released it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ours.Write([]byte{1})
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("device not released")
+	}
+}
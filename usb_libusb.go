@@ -19,22 +19,32 @@ package main
 import (
 	"context"
 	"fmt"
-	"sync"
+	"sort"
 	"time"
 
 	"github.com/google/gousb"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+// The endpoints of the device, which tests stand in for.
+type usbOutEndpoint interface {
+	WriteContext(ctx context.Context, buf []byte) (int, error)
+}
+
+type usbInEndpoint interface {
+	ReadContext(ctx context.Context, buf []byte) (int, error)
+}
+
 var state struct {
 	ctx       *gousb.Context
 	device    *gousb.Device
 	config    *gousb.Config
 	iface     *gousb.Interface
-	wendpoint *gousb.OutEndpoint
-	rendpoint *gousb.InEndpoint
-
-	mtx sync.Mutex
+	wendpoint usbOutEndpoint
+	rendpoint usbInEndpoint
+	serial    string
 }
 
 func usbopen(cid string, serial string) (err error) {
@@ -46,8 +56,17 @@ func usbopen(cid string, serial string) (err error) {
 		}
 	}
 	if state.device != nil {
-		log.WithField("Correlation-ID", cid).Debug("usb device already open")
-		return nil
+		if serial == "" || serial == state.serial {
+			log.WithField("Correlation-ID", cid).Debug("usb device already open")
+			return nil
+		}
+		// The serial asked for changed since, by a reload.
+		log.WithFields(log.Fields{
+			"Correlation-ID": cid,
+			"Device-Serial":  state.serial,
+			"Wanted-Serial":  serial,
+		}).Debug("closing usb device for another serial")
+		usbclose(cid)
 	}
 
 	var devs []*gousb.Device
@@ -94,6 +113,7 @@ func usbopen(cid string, serial string) (err error) {
 				state.device.Close()
 			}
 			state.device = dev
+			state.serial = serialnumber
 		}
 	}
 	if state.device == nil {
@@ -122,7 +142,7 @@ func usbopen(cid string, serial string) (err error) {
 		goto out
 	}
 
-	usbread(cid, 1*time.Millisecond)
+	usbread(context.Background(), cid, 1*time.Millisecond)
 
 	return nil
 
@@ -143,6 +163,7 @@ func usbclose(cid string) {
 	if state.device != nil {
 		state.device.Close()
 		state.device = nil
+		state.serial = ""
 	}
 }
 
@@ -156,9 +177,12 @@ func usbreopen(cid string, why error, serial string) (err error) {
 	return usbopen(cid, serial)
 }
 
-func usbCheck(cid string, serial string) (err error) {
-	state.mtx.Lock()
-	defer state.mtx.Unlock()
+func usbCheck(ctx context.Context, cid string, serial string) (err error) {
+	release, err := deviceScheduler.acquire(ctx, cid)
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	if err = usbopen(cid, serial); err != nil {
 		return err
@@ -183,11 +207,54 @@ func usbCheck(cid string, serial string) (err error) {
 	return nil
 }
 
-func usbwrite(buf []byte, cid string) (err error) {
+// usbList returns the serials of all attached devices.
+func usbList(ctx context.Context, cid string) (serials []string, err error) {
+	release, err := deviceScheduler.acquire(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if state.ctx == nil {
+		state.ctx = gousb.NewContext()
+		if state.ctx == nil {
+			return nil, fmt.Errorf("unable to create a usb context")
+		}
+	}
+
+	devs, err := state.ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		return desc.Vendor == 0x1050 && desc.Product == 0x0030
+	})
+	// As in usbopen, errors from devices we're not interested in are
+	// of no concern.
+	if len(devs) == 0 && err != nil {
+		return nil, err
+	}
+	for _, dev := range devs {
+		serial, err := dev.SerialNumber()
+		dev.Close()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Correlation-ID": cid,
+				"Device":         dev,
+				"Error":          err,
+			}).Debug("Couldn't read serial number from device")
+			continue
+		}
+		serials = append(serials, serial)
+	}
+	sort.Strings(serials)
+	return serials, nil
+}
+
+func usbwrite(ctx context.Context, buf []byte, cid string) (err error) {
 	var n int
-	var ctx context.Context
 
-	ctx = context.Background()
+	_, span := startSpan(ctx, "usb write", cid,
+		attribute.String("yubihsm.serial", state.serial),
+		attribute.Int("usb.len", len(buf)))
+	defer span.End()
+
 	if n, err = state.wendpoint.WriteContext(ctx, buf); err != nil {
 		goto out
 	}
@@ -199,6 +266,9 @@ func usbwrite(buf []byte, cid string) (err error) {
 	}
 
 out:
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
 	log.WithFields(log.Fields{
 		"Correlation-ID": cid,
 		"n":              n,
@@ -210,12 +280,14 @@ out:
 	return err
 }
 
-func usbread(cid string, timeout time.Duration) (buf []byte, err error) {
+func usbread(ctx context.Context, cid string, timeout time.Duration) (buf []byte, err error) {
 	var n int
-	var ctx context.Context
+
+	_, span := startSpan(ctx, "usb read", cid,
+		attribute.String("yubihsm.serial", state.serial))
+	defer span.End()
 
 	buf = make([]byte, 8192)
-	ctx = context.Background()
 	if timeout > 0 {
 		var cancel func()
 		ctx, cancel = context.WithTimeout(ctx, timeout)
@@ -228,6 +300,10 @@ func usbread(cid string, timeout time.Duration) (buf []byte, err error) {
 	buf = buf[:n]
 
 out:
+	span.SetAttributes(attribute.Int("usb.len", len(buf)))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
 	log.WithFields(log.Fields{
 		"Correlation-ID": cid,
 		"n":              n,
@@ -239,25 +315,94 @@ out:
 	return buf, err
 }
 
-func usbProxy(req []byte, cid string, serial string) (resp []byte, err error) {
-	state.mtx.Lock()
-	defer state.mtx.Unlock()
+func usbProxy(ctx context.Context, req []byte, cid string, serial string) (resp []byte, err error) {
+	_, span := startSpan(ctx, "usb lock", cid,
+		attribute.String("yubihsm.serial", serial))
+	release, err := deviceScheduler.acquire(ctx, cid)
+	span.End()
+	if err != nil {
+		return nil, err
+	}
+	ctx, stop := deviceScheduler.abortable(ctx)
+	defer stop()
 
 	if err = usbopen(cid, serial); err != nil {
+		release()
 		return nil, err
 	}
 
 	for i := 0; i < 2; i++ {
-		if err = usbwrite(req, cid); err != nil {
+		if err = usbwrite(ctx, req, cid); err != nil {
+			if ctx.Err() != nil {
+				// A partially written frame leaves the device in an
+				// unknown state, start over with the next caller.
+				usbclose(cid)
+				break
+			}
 			if err2 := usbreopen(cid, err, serial); err2 != nil {
+				release()
 				return nil, err2
 			}
 			continue
 		}
 
-		resp, err = usbread(cid, 0)
+		resp, err = readResponse(cid, req, func() ([]byte, error) {
+			return usbread(ctx, cid, 0)
+		})
+		if err == errDesync {
+			usbreset(cid, serial)
+			break
+		}
+		if err != nil && ctx.Err() != nil {
+			// The device will answer the command regardless. Hold on to
+			// it until it has, so the answer isn't handed to whoever is
+			// next in line.
+			go usbdrain(cid, release)
+			return nil, ctx.Err()
+		}
 		break
 	}
 
+	release()
 	return resp, err
 }
+
+// usbreset discards whatever the device has queued up for us and reopens
+// it, after we've lost track of which response belongs to which command.
+func usbreset(cid string, serial string) {
+	for {
+		if _, err := usbread(context.Background(), cid, 10*time.Millisecond); err != nil {
+			break
+		}
+	}
+	if err := usbreopen(cid, errDesync, serial); err != nil {
+		log.WithFields(log.Fields{
+			"Correlation-ID": cid,
+			"Error":          err,
+		}).Warn("failed reopening device after desynchronization")
+	}
+}
+
+// usbdrain reads and discards the answer to an abandoned command, then
+// hands the device on. If no answer arrives, or the scheduler aborts the
+// wait, the device is closed, to be reopened and drained by the next
+// caller.
+func usbdrain(cid string, release func()) {
+	defer release()
+
+	ctx, stop := deviceScheduler.abortable(context.Background())
+	defer stop()
+	buf, err := usbread(ctx, cid, staleResponseTimeout)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Correlation-ID": cid,
+			"Error":          err,
+		}).Warn("no answer to abandoned command, resetting device")
+		usbclose(cid)
+		return
+	}
+	log.WithFields(log.Fields{
+		"Correlation-ID": cid,
+		"len":            len(buf),
+	}).Debug("discarded answer to abandoned command")
+}
@@ -521,7 +521,9 @@ DWORD usbWrite(PDEVICE_CONTEXT device, PUCHAR buffer, ULONG bufferSizeInBytes, P
     return ERROR_SUCCESS;
 }
 
-DWORD usbRead(PDEVICE_CONTEXT device, PUCHAR buffer, ULONG bufferSizeInBytes, PULONG bytesTransferred)
+// timeout is in milliseconds, 0 waits for as long as it takes. A read
+// that times out fails with ERROR_SEM_TIMEOUT.
+DWORD usbRead(PDEVICE_CONTEXT device, PUCHAR buffer, ULONG bufferSizeInBytes, PULONG bytesTransferred, ULONG timeout)
 {
     if (!device || !device->initialized)
     {
@@ -533,6 +535,15 @@ DWORD usbRead(PDEVICE_CONTEXT device, PUCHAR buffer, ULONG bufferSizeInBytes, PU
         return ERROR_INVALID_PARAMETER;
     }
 
+    if (!WinUsb_SetPipePolicy(device->usbInterface,
+                              device->readPipe,
+                              PIPE_TRANSFER_TIMEOUT,
+                              sizeof(timeout),
+                              &timeout))
+    {
+        return GetLastError();
+    }
+
     if (!WinUsb_ReadPipe(device->usbInterface,
                          device->readPipe,
                          buffer,
@@ -40,6 +40,6 @@ extern DWORD usbOpen(int vendorId, int productId, char* serialNumber, PDEVICE_CO
 extern void  usbClose(PDEVICE_CONTEXT* device);
 extern DWORD usbCheck(PDEVICE_CONTEXT device, int vendorId, int productId);
 extern DWORD usbWrite(PDEVICE_CONTEXT device, PUCHAR buffer, ULONG bufferSizeInBytes, PULONG bytesTransferred);
-extern DWORD usbRead(PDEVICE_CONTEXT device, PUCHAR buffer, ULONG bufferSizeInBytes, PULONG bytesTransferred);
+extern DWORD usbRead(PDEVICE_CONTEXT device, PUCHAR buffer, ULONG bufferSizeInBytes, PULONG bytesTransferred, ULONG timeout);
 
 #endif // USB_WINDOWS_H_GUARD
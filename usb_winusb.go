@@ -18,11 +18,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"sync"
+	"time"
 	"unsafe"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // #cgo CFLAGS: -DUNICODE -D_UNICODE
@@ -31,8 +34,8 @@ import (
 import "C"
 
 var device struct {
-	ctx C.PDEVICE_CONTEXT
-	mtx sync.Mutex
+	ctx    C.PDEVICE_CONTEXT
+	serial string
 }
 
 type C_DWORD C.DWORD
@@ -52,6 +55,7 @@ const (
 	ERROR_NOT_SUPPORTED     C_DWORD = C.ERROR_NOT_SUPPORTED
 	ERROR_SHARING_VIOLATION C_DWORD = C.ERROR_SHARING_VIOLATION
 	ERROR_BAD_COMMAND       C_DWORD = C.ERROR_BAD_COMMAND
+	ERROR_SEM_TIMEOUT       C_DWORD = C.ERROR_SEM_TIMEOUT
 )
 
 func winusbError(err C.DWORD) error {
@@ -63,8 +67,12 @@ func winusbError(err C.DWORD) error {
 
 func usbopen(cid string, serial string) (err error) {
 	if device.ctx != nil {
-		log.WithField("Correlation-ID", cid).Debug("usb context already open")
-		return nil
+		if device.serial == serial {
+			log.WithField("Correlation-ID", cid).Debug("usb context already open")
+			return nil
+		}
+		// The serial asked for changed since, by a reload.
+		usbclose(cid)
 	}
 
 	if serial != "" {
@@ -79,6 +87,7 @@ func usbopen(cid string, serial string) (err error) {
 	if device.ctx == nil {
 		err = fmt.Errorf("device not found")
 	}
+	device.serial = serial
 
 	return err
 }
@@ -99,9 +108,12 @@ func usbreopen(cid string, why error, serial string) (err error) {
 	return usbopen(cid, serial)
 }
 
-func usbCheck(cid string, serial string) (err error) {
-	device.mtx.Lock()
-	defer device.mtx.Unlock()
+func usbCheck(ctx context.Context, cid string, serial string) (err error) {
+	release, err := deviceScheduler.acquire(ctx, cid)
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	if err = usbopen(cid, serial); err != nil {
 		return err
@@ -126,9 +138,30 @@ func usbCheck(cid string, serial string) (err error) {
 	return nil
 }
 
-func usbwrite(buf []byte, cid string) (err error) {
+// usbList returns the serials of attached devices. Enumerating devices
+// isn't supported here, so this is only ever the one in use, and only
+// when it was chosen by serial.
+func usbList(ctx context.Context, cid string) (serials []string, err error) {
+	release, err := deviceScheduler.acquire(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if device.ctx == nil || device.serial == "" {
+		return nil, fmt.Errorf("listing devices is not supported on windows")
+	}
+	return []string{device.serial}, nil
+}
+
+func usbwrite(ctx context.Context, buf []byte, cid string) (err error) {
 	var n C.ULONG
 
+	_, span := startSpan(ctx, "usb write", cid,
+		attribute.String("yubihsm.serial", device.serial),
+		attribute.Int("usb.len", len(buf)))
+	defer span.End()
+
 	if err = winusbError(C.usbWrite(
 		device.ctx,
 		(*C.UCHAR)(unsafe.Pointer(&buf[0])),
@@ -138,6 +171,9 @@ func usbwrite(buf []byte, cid string) (err error) {
 	}
 
 out:
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
 	log.WithFields(log.Fields{
 		"Correlation-ID": cid,
 		"n":              uint(n),
@@ -149,22 +185,53 @@ out:
 	return err
 }
 
-func usbread(cid string) (buf []byte, err error) {
+// usbread reads from the device, giving up after timeout, if any, or once
+// the deadline of ctx has passed. WinUSB transfers can't be cancelled
+// otherwise.
+func usbread(ctx context.Context, cid string, timeout time.Duration) (buf []byte, err error) {
 	var n C.ULONG
 
+	_, span := startSpan(ctx, "usb read", cid,
+		attribute.String("yubihsm.serial", device.serial))
+	defer span.End()
+
 	buf = make([]byte, 8192)
 
+	// Timing out at the deadline of ctx is reported as its error, for
+	// the caller to drain the answer.
+	byDeadline := false
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); timeout == 0 || left < timeout {
+			timeout, byDeadline = left, true
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		buf = buf[:0]
+		goto out
+	}
+	if timeout > 0 && timeout < time.Millisecond {
+		timeout = time.Millisecond
+	}
+
 	if err = winusbError(C.usbRead(
 		device.ctx,
 		(*C.UCHAR)(unsafe.Pointer(&buf[0])),
 		C.ULONG(len(buf)),
-		&n)); err != nil {
+		&n,
+		C.ULONG(timeout/time.Millisecond))); err != nil {
+		if err == ERROR_SEM_TIMEOUT && byDeadline {
+			err = context.DeadlineExceeded
+		}
 		buf = buf[:0]
 		goto out
 	}
 	buf = buf[:n]
 
 out:
+	span.SetAttributes(attribute.Int("usb.len", len(buf)))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
 	log.WithFields(log.Fields{
 		"Correlation-ID": cid,
 		"n":              uint(n),
@@ -176,25 +243,96 @@ out:
 	return buf, err
 }
 
-func usbProxy(req []byte, cid string, serial string) (resp []byte, err error) {
-	device.mtx.Lock()
-	defer device.mtx.Unlock()
+// WinUSB writes can't be cancelled from here, so a request's deadline is
+// checked before its command is written, and bounds the read of the
+// answer.
+func usbProxy(ctx context.Context, req []byte, cid string, serial string) (resp []byte, err error) {
+	_, span := startSpan(ctx, "usb lock", cid,
+		attribute.String("yubihsm.serial", serial))
+	release, err := deviceScheduler.acquire(ctx, cid)
+	span.End()
+	if err != nil {
+		return nil, err
+	}
 
 	if err = usbopen(cid, serial); err != nil {
+		release()
 		return nil, err
 	}
 
 	for i := 0; i < 2; i++ {
-		if err = usbwrite(req, cid); err != nil {
+		if err = ctx.Err(); err != nil {
+			release()
+			return nil, err
+		}
+		if err = usbwrite(ctx, req, cid); err != nil {
 			if err2 := usbreopen(cid, err, serial); err2 != nil {
+				release()
 				return nil, err2
 			}
 			continue
 		}
 
-		resp, err = usbread(cid)
+		resp, err = readResponse(cid, req, func() ([]byte, error) {
+			return usbread(ctx, cid, 0)
+		})
+		if err == errDesync {
+			usbreset(cid, serial)
+			break
+		}
+		if err == context.DeadlineExceeded || err != nil && ctx.Err() != nil {
+			// The device will answer the command regardless. Hold on to
+			// it until it has, so the answer isn't handed to whoever is
+			// next in line.
+			go usbdrain(cid, release)
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, err
+		}
 		break
 	}
 
+	release()
 	return resp, err
 }
+
+// usbreset discards whatever the device has queued up for us and reopens
+// it, after we've lost track of which response belongs to which command.
+func usbreset(cid string, serial string) {
+	for {
+		if _, err := usbread(context.Background(), cid, 10*time.Millisecond); err != nil {
+			break
+		}
+	}
+	if err := usbreopen(cid, errDesync, serial); err != nil {
+		log.WithFields(log.Fields{
+			"Correlation-ID": cid,
+			"Error":          err,
+		}).Warn("failed reopening device after desynchronization")
+	}
+}
+
+// usbdrain reads and discards the answer to an abandoned command, then
+// hands the device on. If no answer arrives, or the scheduler aborts the
+// wait, the device is closed, to be reopened and drained by the next
+// caller.
+func usbdrain(cid string, release func()) {
+	defer release()
+
+	ctx, stop := deviceScheduler.abortable(context.Background())
+	defer stop()
+	buf, err := usbread(ctx, cid, staleResponseTimeout)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Correlation-ID": cid,
+			"Error":          err,
+		}).Warn("no answer to abandoned command, resetting device")
+		usbclose(cid)
+		return
+	}
+	log.WithFields(log.Fields{
+		"Correlation-ID": cid,
+		"len":            len(buf),
+	}).Debug("discarded answer to abandoned command")
+}
@@ -0,0 +1,325 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Peers are pinged this often, and dropped when they haven't answered
+// within wsPongWait.
+const (
+	wsPingPeriod = 30 * time.Second
+	wsPongWait   = 2 * wsPingPeriod
+	wsWriteWait  = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  max_len,
+	WriteBufferSize: max_len,
+}
+
+var websocketsOpen = newGauge("yubihsm_connector_websockets",
+	"Open WebSocket connections.")
+
+// wsConn is a WebSocket connection, and the device sessions created
+// over it.
+type wsConn struct {
+	id       string
+	client   string
+	sessions map[byte]bool
+}
+
+// wsRegistry keeps track of open WebSockets and which of them owns which
+// device session. Frames for a session owned by one socket are refused
+// on all others.
+type wsRegistry struct {
+	mtx    sync.Mutex
+	conns  map[*wsConn]bool
+	owners map[byte]*wsConn
+}
+
+var sockets = &wsRegistry{
+	conns:  map[*wsConn]bool{},
+	owners: map[byte]*wsConn{},
+}
+
+func (g *wsRegistry) open(id string, client string) *wsConn {
+	c := &wsConn{id: id, client: client, sessions: map[byte]bool{}}
+
+	g.mtx.Lock()
+	g.conns[c] = true
+	g.mtx.Unlock()
+	websocketsOpen.add(1)
+	return c
+}
+
+// close forgets c, returning the sessions it owned.
+func (g *wsRegistry) close(c *wsConn) (sessions []byte) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	for id := range c.sessions {
+		if g.owners[id] == c {
+			delete(g.owners, id)
+		}
+		sessions = append(sessions, id)
+	}
+	delete(g.conns, c)
+	websocketsOpen.add(-1)
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i] < sessions[j] })
+	return sessions
+}
+
+// observe takes note of a session created by the exchange of req and
+// resp, on behalf of c. A nil c is a request from elsewhere, like the
+// HTTP API; the device having handed out the session ID again means the
+// previous owner is done with it.
+func (g *wsRegistry) observe(c *wsConn, req []byte, resp []byte) {
+	if len(req) == 0 || req[0] != cmdCreateSession {
+		return
+	}
+	f, err := parseFrame(resp)
+	if err != nil {
+		return
+	}
+	id, ok := f.sessionID()
+	if !ok {
+		return
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if prev := g.owners[id]; prev != nil {
+		delete(prev.sessions, id)
+		delete(g.owners, id)
+	}
+	if c != nil {
+		g.owners[id] = c
+		c.sessions[id] = true
+	}
+}
+
+// permit reports whether c may send req, refusing frames for sessions
+// owned by another socket.
+func (g *wsRegistry) permit(c *wsConn, req []byte) bool {
+	f, err := parseFrame(req)
+	if err != nil {
+		return true
+	}
+	id, ok := f.sessionID()
+	if !ok {
+		return true
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	owner := g.owners[id]
+	return owner == nil || owner == c
+}
+
+type wsStat struct {
+	id       string
+	client   string
+	sessions []byte
+}
+
+func (g *wsRegistry) stats() (conns []wsStat) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	for c := range g.conns {
+		st := wsStat{id: c.id, client: c.client}
+		for id := range c.sessions {
+			st.sessions = append(st.sessions, id)
+		}
+		sort.Slice(st.sessions, func(i, j int) bool { return st.sessions[i] < st.sessions[j] })
+		conns = append(conns, st)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+func sessionList(sessions []byte) string {
+	ids := make([]string, len(sessions))
+	for i, id := range sessions {
+		ids[i] = strconv.Itoa(int(id))
+	}
+	return strings.Join(ids, ":")
+}
+
+// wsHandler exchanges frames over a WebSocket: each binary message is a
+// frame for the device, answered by a binary message with the response.
+// Requests that fail are answered by a text message holding problem
+// details, leaving the connection open.
+func wsHandler(w http.ResponseWriter, r *http.Request, serial string) {
+	cid := r.Header.Get("X-Request-ID")
+	clog := log.WithFields(log.Fields{
+		"X-Request-ID": cid,
+	})
+
+	timeout, err := requestTimeout(r.Header.Get("X-Request-Timeout"), maxRequestTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has answered already.
+		clog.WithError(err).Warn("websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	client := identityFrom(r.Context())
+	c := sockets.open(cid, client.id)
+	clog.WithField("client", client.id).Debug("websocket opened")
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	conn.SetReadLimit(max_len)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go func() {
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var seq int
+	defer func() {
+		clog.WithFields(log.Fields{
+			"client":   client.id,
+			"frames":   seq,
+			"sessions": sessionList(sockets.close(c)),
+		}).Info("websocket closed")
+	}()
+
+	for ; ; seq++ {
+		kind, req, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				clog.WithError(err).Debug("websocket read failed")
+			}
+			return
+		}
+		if kind != websocket.BinaryMessage {
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseUnsupportedData, "binary frames only"),
+				time.Now().Add(wsWriteWait))
+			return
+		}
+
+		mcid := fmt.Sprintf("%s/%d", cid, seq)
+		now := time.Now()
+		resp, p := wsExchange(ctx, c, client, req, mcid, serial, timeout)
+		mlog := clog.WithFields(log.Fields{
+			"frame":   seq,
+			"latency": time.Since(now),
+		})
+
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if p != nil {
+			mlog.WithField("StatusCode", p.Status).Warn(p.Detail)
+			err = conn.WriteJSON(p)
+		} else {
+			mlog.Debug("handled websocket frame")
+			err = conn.WriteMessage(websocket.BinaryMessage, resp)
+		}
+		if err != nil {
+			clog.WithError(err).Warn("websocket write failed")
+			return
+		}
+		// Long running commands must not count against the peer.
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	}
+}
+
+// wsExchange runs a single frame from a WebSocket, subject to the same
+// policy and checks as one to apiHandler.
+func wsExchange(ctx context.Context, c *wsConn, client identity, req []byte, cid string, serial string, timeout time.Duration) (resp []byte, p *problem) {
+	fail := func(status int, detail string) ([]byte, *problem) {
+		return nil, &problem{
+			Type:   "about:blank",
+			Title:  http.StatusText(status),
+			Status: status,
+			Detail: detail,
+		}
+	}
+
+	if retryAfter, ok := activePolicy.Load().limits.allow(client); !ok {
+		audit("rate-limited", log.Fields{
+			"X-Request-ID": cid,
+			"client":       client.id,
+			"policy":       client.entry.Name,
+			"URI":          "/connector/ws",
+		})
+		return fail(http.StatusTooManyRequests, fmt.Sprintf("client over limits, retry after %s", retryAfter))
+	}
+	if len(req) < min_len {
+		return fail(http.StatusBadRequest, errFrameShort.Error())
+	}
+	if err := validateRequest(req, allowUnknownCommands); err != nil {
+		return fail(http.StatusBadRequest, err.Error())
+	}
+	if !sockets.permit(c, req) {
+		audit("session-denied", log.Fields{
+			"X-Request-ID": cid,
+			"client":       client.id,
+		})
+		return fail(http.StatusForbidden, "session belongs to another connection")
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	resp, err := deviceProxy(ctx, req, cid, serial)
+	if err != nil {
+		return fail(proxyErrorStatus(err), err.Error())
+	}
+	if err = rec.record(req, resp); err != nil {
+		log.WithField("X-Request-ID", cid).WithError(err).Warn("failed recording exchange")
+	}
+	sockets.observe(c, req, resp)
+	return resp, nil
+}
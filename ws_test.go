@@ -0,0 +1,89 @@
+// Copyright 2016-2018 Yubico AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketSessions(t *testing.T) {
+	g := &wsRegistry{conns: map[*wsConn]bool{}, owners: map[byte]*wsConn{}}
+	a, b := g.open("a", "client"), g.open("b", "client")
+
+	create := []byte{cmdCreateSession, 0x00, 0x00}
+	g.observe(a, create, []byte{cmdCreateSession | cmdResponse, 0x00, 0x01, 0x05})
+	msg := []byte{cmdSessionMessage, 0x00, 0x01, 0x05}
+	if !g.permit(a, msg) || g.permit(b, msg) {
+		t.Fatal("session 5 should belong to a only")
+	}
+
+	// The device handing out the ID again ends the earlier session.
+	g.observe(nil, create, []byte{cmdCreateSession | cmdResponse, 0x00, 0x01, 0x05})
+	if !g.permit(b, msg) {
+		t.Fatal("session 5 should no longer belong to a")
+	}
+
+	g.observe(b, create, []byte{cmdCreateSession | cmdResponse, 0x00, 0x01, 0x07})
+	if sessions := g.close(b); !bytes.Equal(sessions, []byte{7}) {
+		t.Fatalf("got sessions %v: expected [7]", sessions)
+	}
+	if len(g.stats()) != 1 {
+		t.Fatal("closed connection still listed")
+	}
+}
+
+func TestWebSocketExchange(t *testing.T) {
+	defer func(proxy func(context.Context, []byte, string, string) ([]byte, error)) {
+		deviceProxy = proxy
+	}(deviceProxy)
+	deviceProxy = func(ctx context.Context, req []byte, cid string, serial string) ([]byte, error) {
+		return append([]byte{req[0] | cmdResponse}, req[1:]...), nil
+	}
+
+	srv := httptest.NewServer(middlewareWrapper(func(w http.ResponseWriter, r *http.Request) {
+		wsHandler(w, r, "")
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err = conn.WriteMessage(websocket.BinaryMessage, []byte{cmdEcho, 0x00, 0x01, 0xaa}); err != nil {
+		t.Fatal(err)
+	}
+	kind, resp, err := conn.ReadMessage()
+	if err != nil || kind != websocket.BinaryMessage || !bytes.Equal(resp, []byte{0x81, 0x00, 0x01, 0xaa}) {
+		t.Fatalf("got %d %x, %v", kind, resp, err)
+	}
+
+	// Malformed frames are answered with problem details.
+	if err = conn.WriteMessage(websocket.BinaryMessage, []byte{cmdEcho, 0x00, 0x02, 0xaa}); err != nil {
+		t.Fatal(err)
+	}
+	var p problem
+	if err = conn.ReadJSON(&p); err != nil || p.Status != http.StatusBadRequest {
+		t.Fatalf("got %+v, %v: expected status 400", p, err)
+	}
+}